@@ -5,23 +5,31 @@ Package fastaexploder splits a fasta file in its constituint sequences
 package main
 
 import (
+	"bufio"
 	"errors"
+	"flag"
 	"fmt"
-//	"io"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
+	"sync"
 )
 
 
 import (
 	"github.com/sauloalgolang/fastareader/lib/fastaindex"
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
 	"github.com/sauloalgolang/fastareader/lib/fastatools"
 )
 
 // http://www.golangbootcamp.com/book/tricks_and_tips
 // compile passing -ldflags "-X main.Build <build sha1>"
-var Build string
+var Build    string
+var load_all bool   = false
 
 
 // Error codes returned by failures to parse
@@ -31,13 +39,19 @@ var (
 )
 
 
+// temporary output files, removed on errors and interruptions
+var temps = newTempFiles()
+
+
 /*
 check: This helper will streamline our error checks below.
+       temporary files are removed before exiting
 src  : https://gobyexample.com/reading-files
 input: e error
 */
 func check(e error) {
         if e != nil {
+                temps.removeAll()
                 log.Fatal( e )
                 panic(e)
         }
@@ -45,8 +59,143 @@ func check(e error) {
 
 
 
+var outdir   string
+var files    int
+var maxBases int64
+var records  int
+var group    string
+var threads  int
+func init() {
+	flag.IntVar   (&threads , "threads" , 0 , "number of output files written at the same time. 0 for the number of CPUs")
+	flag.StringVar(&outdir  , "outdir"  , "", "directory of the output files. default: the directory of the input. sequence ids are escaped in file names: bytes other than letters, digits, '_', '-' and '.' are written as %XX")
+	flag.IntVar   (&files   , "files"   , 0 , "split in this number of files with roughly the same number of bases. requires an indexed file")
+	flag.Int64Var (&maxBases, "maxbases", 0 , "split in files of at most this number of bases. larger sequences are written to a file of their own")
+	flag.IntVar   (&records , "records" , 0 , "split in files of this number of sequences")
+	flag.StringVar(&group   , "group"   , "", "split in one file per value of the first capture group of this regular expression in the header. requires an indexed file")
+}
+
+
+
+/*
+parseSplitMode: checks the split flags. at most one can be given
+outputs       : mode *splitMode
+                err  error
+*/
+func parseSplitMode() (mode *splitMode, err error) {
+	mode  = &splitMode{ files: files, maxBases: maxBases, records: records }
+	given := 0
+
+	if files < 0 || maxBases < 0 || records < 0 {
+		return nil, fmt.Errorf("%w: split sizes can not be negative", ErrInternal)
+	}
+
+	if files    > 0 { given++ }
+	if maxBases > 0 { given++ }
+	if records  > 0 { given++ }
+
+	if group != "" {
+		given++
+		if mode.group, err = regexp.Compile(group); err != nil {
+			return nil, fmt.Errorf("%w: -group: %w", ErrInternal, err)
+		}
+	}
+
+	if given > 1 {
+		return nil, fmt.Errorf("%w: only one of -files, -maxbases, -records and -group can be given", ErrInternal)
+	}
+
+	return mode, nil
+}
+
+
+
+/*
+outputPrefix: path and prefix of the output files
+inputs      : filename string
+outputs     : string
+*/
+func outputPrefix(filename string) string {
+	prefix := strings.TrimSuffix(filename, ".gz")
+	if filename == "-" {
+		prefix = "stdin"
+	}
+
+	if outdir != "" {
+		prefix = filepath.Join(outdir, filepath.Base(prefix))
+	}
+
+	return prefix
+}
+
+
+
+/*
+explodeStream: splits a stream (stdin or pipe) reading its sequences sequentially.
+               only modes that do not need the sizes in advance can be used
+inputs       : filename string
+               mode     *splitMode
+               namer    *outputNamer
+*/
+func explodeStream(filename string, mode *splitMode, namer *outputNamer) {
+	if ! mode.sequential() {
+		log.Fatal("-files and -group can not be used with streams")
+	}
+
+	reader, err := fastatools.OpenReader(filename)
+	check(err)
+	defer reader.Close()
+
+	var fo *os.File
+	ofName := ""
+	count  := 0
+	bases  := int64(0)
+	parts  := 0
+
+	for {
+		seqd, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+
+		if fo == nil || mode.startsFile(count, bases, seqd.Size()) {
+			if fo != nil {
+				check(temps.commit(fo, ofName))
+			}
+
+			if mode.records > 0 || mode.maxBases > 0 {
+				ofName = namer.Name(partName(parts))
+			} else {
+				ofName = namer.Name(seqd.SeqName)
+			}
+			parts++
+			count   = 0
+			bases   = 0
+
+			log.Println("Saving to", ofName)
+
+			fo, err = temps.create(ofName)
+			check(err)
+		}
+
+		check(seqd.SaveToFasta(fo))
+		namer.Add(seqd.Header(), ofName)
+		count++
+		bases += seqd.Size()
+	}
+
+	if fo != nil {
+		check(temps.commit(fo, ofName))
+	}
+
+	log.Println("Done")
+}
+
+
+
 /*
-main: checks if index exists, creating it otherwise, read index and create a go routine to read each sequence
+main: checks if index exists, creating it otherwise, read index and create a go routine to read each sequence.
+      streams ("-" for stdin) and plain gzip files are read sequentially
 */
 func main() {
 	if Build != "" {
@@ -54,108 +203,343 @@ func main() {
 	}
 
 
-	argsWithoutProg := os.Args[1:]
+	flag.Parse()
+
+	argsWithoutProg := flag.Args()
 
         if len(argsWithoutProg) != 1 {
-                log.Println("no argument or too many arguments given")
+                log.Println("no argument or too many arguments given. usage: fastaexploder [options] <in.fasta>")
+                flag.PrintDefaults()
                 os.Exit(1)
         }
 
 
         filename        := argsWithoutProg[0]
 
-	f, err := os.Open(filename)
-	check(err)
-	defer f.Close()
+	if outdir != "" {
+		check(os.MkdirAll(outdir, 0755))
+	}
 
-	_, err = f.Stat()
+	mode, err       := parseSplitMode()
 	check(err)
-	//log.Print(d)
 
+	if threads < 0 {
+		flag.PrintDefaults()
+		log.Fatal("Number of threads (", threads, ") must be greater or equal to 0")
+	}
+	if threads == 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	log.Println("threads", threads)
+
+	temps.removeOnSignal()
 
-	var numCPU = runtime.GOMAXPROCS(0)
-	numCPU = 1
+	namer           := newOutputNamer(outputPrefix(filename))
 
-	log.Println("numCPU",numCPU)
+	isSequential, err := fastaio.IsSequential(filename)
+	check(err)
 
+	if fastaio.IsStream(filename) {
+		explodeStream(filename, mode, namer)
+		check(namer.WriteManifest())
+		return
+	}
 
-	idxData         := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
+	index, err      := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
+	check(err)
+	log.Println("Sequences:", index.Len(), "Total size:", index.TotalSize())
 
-	for _, idx := range *idxData {
+	for _, idx := range index.Records() {
 		idx.Print()
 	}
 
-	load_all := false
+	// files are planned before starting, so that names and collisions are resolved in file order
+	outFiles := mode.plan(index.Records(), namer)
+	log.Println("Output files:", len(outFiles))
 
-	//seqData := make([]*fastatools.SeqData, len(*idxData))
 	log.Println("Reading File")
-	var limit  = make(chan int, numCPU)
-	var waiter = make(chan int)
-	for _, idx := range *idxData {
-		//idx.Print()
+	if isSequential {
+		// the input is read once, holding at most threads output files open
+		check(writeFilesSequential(filename, index.Records(), outFiles, threads))
+	} else {
+		// each writer holds one output file and one input file open at a time
+		check(writeFiles(filename, outFiles, threads))
+	}
 
-		f := func (idx2 *fastaindex.IdxData) {
-			ofName  := filename+"_"+idx2.SeqName+".fasta"
-			log.Println("Saving to", ofName)
+	check(namer.WriteManifest())
 
-			fo, err := os.Create(ofName+".tmp")
-			check(err)
+	log.Println("Done")
+}
 
-			defer func() {
-				os.Remove(ofName+".tmp")
-			}()
 
-			defer fo.Close()
 
+/*
+writeFiles: writes the output files using a pool of writers. after the
+            first error no new files are started
+inputs    : filename string
+            outFiles []*outputFile
+            writers  int
+outputs   : err      error - the first error
+*/
+func writeFiles(filename string, outFiles []*outputFile, writers int) (err error) {
+	jobs    := make(chan *outputFile)
+	wg      := sync.WaitGroup{}
+	mux     := sync.Mutex{}
+	failed  := false
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for of := range jobs {
+				mux.Lock()
+				skip := failed
+				mux.Unlock()
+
+				if skip {
+					continue
+				}
 
-			if ( load_all ) {
-				seqd := fastatools.ReadFastaSeq(filename, idx2.SeqPos)
+				if e := writeFile(filename, of, load_all); e != nil {
+					mux.Lock()
+					if ! failed {
+						failed = true
+						err    = e
+					}
+					mux.Unlock()
+				}
+			}
+		}()
+	}
 
-				log.Printf("RES: IDX: NAME '%s' ID %d SIZE %d POSITION %d FASTA: NAME '%s' SIZE %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos, seqd.SeqName, seqd.Size())
+	for _, of := range outFiles {
+		jobs <- of
+	}
+	close(jobs)
 
-				if (( idx2.SeqName != seqd.SeqName ) || (idx2.SeqSize != seqd.Size())) {
-					log.Fatal(fmt.Sprintf("Sequence mismatch. expexted '%s', found '%s'. Expected size %d, found %d", idx2.SeqName, seqd.SeqName, idx2.SeqSize, seqd.Size()))
-					os.Exit(1)
-				}
+	log.Println("Waiting")
+	wg.Wait()
+
+	return err
+}
+
+
+
+/*
+writeFilesSequential: writes the output files reading the input once, in
+                      file order, for files that can not be seeked. at most
+                      writers output files are open at a time. the least
+                      recently written one is closed to open another and
+                      reopened for appending when it gets more sequences
+inputs              : filename string
+                      records  []*fastaindex.IdxData - in file order
+                      outFiles []*outputFile
+                      writers  int
+outputs             : err      error
+*/
+func writeFilesSequential(filename string, records []*fastaindex.IdxData, outFiles []*outputFile, writers int) (err error) {
+	fileOf  := make(map[*fastaindex.IdxData]*outputFile, len(records))
+	left    := make(map[*outputFile]int, len(outFiles))
+	for _, of := range outFiles {
+		for _, idx := range of.records {
+			fileOf[idx] = of
+		}
+		left[of] = len(of.records)
+	}
+
+	reader, err := fastatools.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	temp    := make(map[*outputFile]*os.File) // started and not committed
+	open    := make(map[*outputFile]int)      // open files and when they were last written
+
+	for seqNum, idx := range records {
+		seqd, err := reader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%w: %s: sequence '%s' of the index not found", ErrInvalidSeq, filename, idx.SeqName)
+		}
+		if err != nil {
+			return err
+		}
 
-				seqd.SaveToFasta(fo)
+		if ( ! idx.MatchesName(seqd.SeqName) ) || (idx.SeqSize != seqd.Size()) {
+			return fmt.Errorf("%w: sequence mismatch. expexted '%s', found '%s'. Expected size %d, found %d", ErrInvalidSeq, idx.SeqName, seqd.SeqName, idx.SeqSize, seqd.Size())
+		}
 
-				seqd.Sequence = make([]byte,0)
+		of      := fileOf[idx]
+		fo, ok  := temp[of]
+		if _, isOpen := open[of]; ! isOpen {
+			if len(open) >= writers {
+				if err = suspendOldest(open, temp); err != nil {
+					return err
+				}
+			}
+
+			if ok {
+				fo, err = temps.resume(fo)
 			} else {
-				log.Printf("READING: IDX: NAME '%s' ID %d SIZE %d POSITION %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos)
+				log.Println("Saving to", of.name, "sequences:", len(of.records), "bases:", of.bases)
+				fo, err = temps.create(of.name)
+			}
+			if err != nil {
+				return err
+			}
+			temp[of] = fo
+		}
+		open[of] = seqNum
 
-				fastatools.ReadFastaSeqIter(filename, idx2.SeqPos, fastatools.GetPipeFastaBackClbk(fo))
+		// keep the line width of the input, as copying from indexed files does
+		width   := fastatools.DefaultLineWidth
+		if idx.HasLineLayout() {
+			width = int(idx.LineBases)
+		}
 
-				log.Printf("READ   : IDX: NAME '%s' ID %d SIZE %d POSITION %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos)
+		fw      := fastatools.NewWriter(fo, width)
+		if err = fw.Write(seqd); err == nil {
+			err = fw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		left[of]--
+		if left[of] == 0 {
+			delete(open, of)
+			delete(temp, of)
+			if err = temps.commit(fo, of.name); err != nil {
+				return err
 			}
+		}
+	}
+
+	return nil
+}
 
-			fo.Close()
 
-		        os.Rename(ofName+".tmp", ofName)
 
-			waiter <- 1
+/*
+suspendOldest: closes the least recently written of the open output files
+inputs       : open map[*outputFile]int - open files and when they were last written
+               temp map[*outputFile]*os.File
+outputs      : err  error
+*/
+func suspendOldest(open map[*outputFile]int, temp map[*outputFile]*os.File) (err error) {
+	var oldest *outputFile
+	for of, last := range open {
+		if oldest == nil || last < open[oldest] {
+			oldest = of
 		}
+	}
+
+	delete(open, oldest)
 
-		go func(w func(idx2 *fastaindex.IdxData), idx2 *fastaindex.IdxData) {
-			limit <- 1
-			w(idx2)
-			<-limit
-		}(f, idx)
+	return temps.suspend(temp[oldest])
+}
+
+
+
+/*
+writeFile: writes the sequences of an output file, in file order
+inputs   : filename string
+           of       *outputFile
+           load_all bool - read whole sequences in memory instead of line by line
+outputs  : err      error
+*/
+func writeFile(filename string, of *outputFile, load_all bool) (err error) {
+	log.Println("Saving to", of.name, "sequences:", len(of.records), "bases:", of.bases)
+
+	fo, err := temps.create(of.name)
+	if err != nil {
+		return err
 	}
+	defer temps.discard(fo)
+
+	for _, idx := range of.records {
+		if err = writeSeq(filename, idx, fo, load_all); err != nil {
+			return err
+		}
+	}
+
+	return temps.commit(fo, of.name)
+}
 
-	log.Println("Waiting")
 
 
-	for i := 1; i <= len(*idxData); i++ {
-		<-waiter
+/*
+writeSeq: copies a sequence of an indexed file to an output file
+inputs  : filename string
+          idx2     *fastaindex.IdxData
+          fo       *os.File
+          load_all bool - read the whole sequence in memory instead of line by line
+outputs : err      error
+*/
+func writeSeq(filename string, idx2 *fastaindex.IdxData, fo *os.File, load_all bool) (err error) {
+	if ( load_all ) {
+		seqd, err := fastatools.ReadFastaSeq(filename, idx2.SeqPos)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("RES: IDX: NAME '%s' ID %d SIZE %d POSITION %d FASTA: NAME '%s' SIZE %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos, seqd.SeqName, seqd.Size())
+
+		if (( ! idx2.MatchesName(seqd.SeqName) ) || (idx2.SeqSize != seqd.Size())) {
+			return fmt.Errorf("%w: sequence mismatch. expexted '%s', found '%s'. Expected size %d, found %d", ErrInvalidSeq, idx2.SeqName, seqd.SeqName, idx2.SeqSize, seqd.Size())
+		}
+
+		return seqd.SaveToFasta(fo)
 	}
 
+	log.Printf("READING: IDX: NAME '%s' ID %d SIZE %d POSITION %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos)
 
-	log.Println("Done")
+	reader, err := fastatools.OpenReaderAt(filename, idx2.SeqPos)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	seqd, err   := reader.NextHeader()
+	if err != nil {
+		return err
+	}
+	if ! idx2.MatchesName(seqd.SeqName) {
+		return fmt.Errorf("%w: sequence mismatch. expexted '%s', found '%s'", ErrInvalidSeq, idx2.SeqName, seqd.SeqName)
+	}
+
+	// lines are copied as they are, keeping the line width of the input
+	bw          := bufio.NewWriter(fo)
+	if _, err = fmt.Fprintf(bw, ">%s\n", seqd.Header()); err != nil {
+		return err
+	}
+
+	size        := int64(0)
+	for {
+		line, err := reader.ReadSeqLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		size += int64(len(line))
+		bw.Write(line)
+		if err = bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
 
-	/*
-	for _, seq := range seqData {
-		seq.Print()
+	if size != idx2.SeqSize {
+		return fmt.Errorf("%w: sequence mismatch. expected size %d for '%s', found %d", ErrInvalidSeq, idx2.SeqSize, idx2.SeqName, size)
 	}
-	*/
+
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("READ   : IDX: NAME '%s' ID %d SIZE %d POSITION %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos)
+
+	return nil
 }
@@ -0,0 +1,265 @@
+package main
+
+// names of the output files and the manifest
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+)
+
+
+// Extension of the manifest written next to the output files
+const manifestExt = ".manifest.tsv"
+
+
+/*
+escapeName: makes a sequence id safe to be used in a filename. letters,
+            digits, '_', '-' and '.' are kept. any other byte is written as
+            %XX, its hexadecimal value, as are a leading '.' and '%' itself,
+            so that names never start a hidden file or walk up directories
+            and the original id can always be recovered
+inputs    : name string
+outputs   : string
+*/
+func escapeName(name string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		   c == '_' || c == '-' || (c == '.' && i != 0) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+
+	return sb.String()
+}
+
+
+type manifestEntry struct {
+	header string
+	file   string
+}
+
+/*
+outputNamer: gives each sequence a unique output file name and keeps the
+             list for the manifest
+*/
+type outputNamer struct {
+	prefix  string          // path and prefix of the output files
+	used    map[string]bool // lower case names, for case insensitive file systems
+	entries []manifestEntry
+}
+
+func newOutputNamer(prefix string) *outputNamer {
+	return &outputNamer{ prefix: prefix, used: make(map[string]bool) }
+}
+
+/*
+Name   : unique output file name of a sequence or group. names that collide
+         with a previous one, because of duplicated ids or case insensitive
+         file systems, get a numeric suffix
+inputs : id string
+outputs: string
+*/
+func (n *outputNamer) Name(id string) string {
+	escaped := escapeName(id)
+	if escaped != id {
+		log.Printf("Escaped sequence name '%s' as '%s'\n", id, escaped)
+	}
+
+	base   := n.prefix + "_" + escaped + ".fasta"
+	ofName := base
+
+	for i := 2; n.used[strings.ToLower(ofName)]; i++ {
+		ofName = fmt.Sprintf("%s_%s.%d.fasta", n.prefix, escaped, i)
+	}
+
+	if ofName != base {
+		log.Printf("Output name of '%s' collides with a previous sequence. saving as %s\n", id, ofName)
+	}
+
+	n.used[strings.ToLower(ofName)] = true
+
+	return ofName
+}
+
+/*
+Add    : adds a sequence to the manifest
+inputs : header string
+         ofName string - output file holding the sequence
+*/
+func (n *outputNamer) Add(header string, ofName string) {
+	n.entries = append(n.entries, manifestEntry{ header: header, file: ofName })
+}
+
+/*
+WriteManifest: writes a tab separated file with the original header and
+               the output file of each sequence, in input order. files are
+               relative to the manifest, which is written next to them
+outputs      : err error
+creates      : prefix.manifest.tsv
+*/
+func (n *outputNamer) WriteManifest() (err error) {
+	mfName  := n.prefix + manifestExt
+
+	fo, err := fastaio.CreateTemp(mfName)
+	if err != nil {
+		return err
+	}
+	defer fastaio.DiscardTemp(fo)
+
+	if _, err = fmt.Fprintln(fo, "#header\tfile"); err != nil {
+		return err
+	}
+
+	for _, e := range n.entries {
+		// tabs in the header would add columns
+		if _, err = fmt.Fprintf(fo, "%s\t%s\n", strings.ReplaceAll(e.header, "\t", " "), filepath.Base(e.file)); err != nil {
+			return err
+		}
+	}
+
+	if err = fastaio.CommitTemp(fo, mfName); err != nil {
+		return err
+	}
+
+	log.Println("Manifest saved to", mfName)
+
+	return nil
+}
+
+
+/*
+tempFiles: temporary output files being written. they are removed if the
+           run fails or is interrupted, so that no partial files are left
+*/
+type tempFiles struct {
+	mux   sync.Mutex
+	files map[*os.File]bool
+}
+
+func newTempFiles() *tempFiles {
+	return &tempFiles{ files: make(map[*os.File]bool) }
+}
+
+/*
+create : creates the temporary file of an output file
+inputs : ofName string
+outputs: *os.File
+         error
+*/
+func (t *tempFiles) create(ofName string) (*os.File, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	fo, err := fastaio.CreateTemp(ofName)
+	if err != nil {
+		return nil, err
+	}
+	t.files[fo] = true
+
+	return fo, nil
+}
+
+/*
+commit : renames a temporary file to its output file
+inputs : fo     *os.File
+         ofName string
+outputs: error
+*/
+func (t *tempFiles) commit(fo *os.File, ofName string) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	delete(t.files, fo)
+
+	return fastaio.CommitTemp(fo, ofName)
+}
+
+/*
+suspend: closes a temporary file without committing it, so that it can be
+         reopened with resume. it is still removed if the run fails
+inputs : fo *os.File
+outputs: error
+*/
+func (t *tempFiles) suspend(fo *os.File) error {
+	return fo.Close()
+}
+
+/*
+resume : reopens a suspended temporary file for appending
+inputs : fo *os.File - the suspended file
+outputs: *os.File    - replaces fo
+         error
+*/
+func (t *tempFiles) resume(fo *os.File) (*os.File, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	fa, err := os.OpenFile(fo.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	delete(t.files, fo)
+	t.files[fa] = true
+
+	return fa, nil
+}
+
+/*
+discard: closes and removes a temporary file. does nothing if it was committed
+inputs : fo *os.File
+*/
+func (t *tempFiles) discard(fo *os.File) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.files[fo] {
+		delete(t.files, fo)
+		fastaio.DiscardTemp(fo)
+	}
+}
+
+/*
+removeAll: closes and removes all temporary files
+*/
+func (t *tempFiles) removeAll() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for fo := range t.files {
+		fastaio.DiscardTemp(fo)
+		delete(t.files, fo)
+	}
+}
+
+/*
+removeOnSignal: removes all temporary files and exits when the process is
+                interrupted or terminated
+*/
+func (t *tempFiles) removeOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Println("Received", sig, "removing temporary files")
+		t.removeAll()
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,219 @@
+package main
+
+// assignment of sequences to output files, planned from the index
+
+import (
+	"container/heap"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaindex"
+)
+
+
+// Group of the records whose header does not match the -group regex
+const unmatchedGroup = "unmatched"
+
+
+/*
+outputFile: an output file and the records it holds, in file order
+*/
+type outputFile struct {
+	name    string
+	records []*fastaindex.IdxData
+	bases   int64
+}
+
+func (of *outputFile) add(idx *fastaindex.IdxData) {
+	of.records = append(of.records, idx)
+	of.bases  += idx.SeqSize
+}
+
+
+/*
+splitMode: how sequences are grouped in output files. at most one of the
+           limits is set. all zero writes one file per sequence
+*/
+type splitMode struct {
+	files    int            // number of files, balanced by bases
+	maxBases int64          // bases per file. larger sequences get a file of their own
+	records  int            // sequences per file
+	group    *regexp.Regexp // one file per value of the first capture group of the header
+}
+
+/*
+sequential: whether the files can be written while reading the sequences
+            one by one, without knowing their sizes in advance
+outputs   : bool
+*/
+func (m *splitMode) sequential() bool {
+	return m.files == 0 && m.group == nil
+}
+
+/*
+startsFile: for sequential modes, whether a sequence must start a new file
+inputs    : count int   - sequences in the current file
+            bases int64 - bases in the current file
+            size  int64 - size of the sequence
+outputs   : bool
+*/
+func (m *splitMode) startsFile(count int, bases int64, size int64) bool {
+	switch {
+	case count == 0:
+		return true
+	case m.records  > 0:
+		return count == m.records
+	case m.maxBases > 0:
+		return bases + size > m.maxBases
+	}
+	return true // one file per sequence
+}
+
+/*
+partName: id of the nth output file of modes that do not name files after
+          sequences or groups
+inputs  : n int - 0 based
+outputs : string
+*/
+func partName(n int) string {
+	return fmt.Sprintf("part%04d", n + 1)
+}
+
+
+/*
+plan   : assigns the records to output files using only their sizes, before
+         any sequence is read. each record is added to the manifest
+inputs : records []*fastaindex.IdxData - in file order
+         namer   *outputNamer
+outputs: files   []*outputFile
+*/
+func (m *splitMode) plan(records []*fastaindex.IdxData, namer *outputNamer) (files []*outputFile) {
+	switch {
+	case m.files > 0:
+		files = m.planBalanced(records, namer)
+	case m.group != nil:
+		files = m.planGroups(records, namer)
+	default:
+		files = m.planSequential(records, namer)
+	}
+
+	fileOf := make(map[*fastaindex.IdxData]string, len(records))
+	for _, of := range files {
+		for _, idx := range of.records {
+			fileOf[idx] = of.name
+		}
+	}
+
+	for _, idx := range records {
+		namer.Add(idx.Header(), fileOf[idx])
+	}
+
+	return files
+}
+
+/*
+planSequential: fills files in file order, one per sequence, up to a
+                number of sequences or up to a number of bases
+*/
+func (m *splitMode) planSequential(records []*fastaindex.IdxData, namer *outputNamer) (files []*outputFile) {
+	var cur *outputFile
+
+	for _, idx := range records {
+		if cur == nil || m.startsFile(len(cur.records), cur.bases, idx.SeqSize) {
+			name := idx.SeqName
+			if m.records > 0 || m.maxBases > 0 {
+				name = partName(len(files))
+			}
+
+			cur   = &outputFile{ name: namer.Name(name) }
+			files = append(files, cur)
+		}
+		cur.add(idx)
+	}
+
+	return files
+}
+
+/*
+planGroups: one file per value of the first capture group of the regex in
+            the header, or of the whole match if it has no groups
+*/
+func (m *splitMode) planGroups(records []*fastaindex.IdxData, namer *outputNamer) (files []*outputFile) {
+	groups := make(map[string]*outputFile)
+
+	for _, idx := range records {
+		key   := unmatchedGroup
+
+		if match := m.group.FindStringSubmatch(idx.Header()); match != nil {
+			key = match[0]
+			if len(match) > 1 {
+				key = match[1]
+			}
+		}
+
+		of, ok := groups[key]
+		if ! ok {
+			of          = &outputFile{ name: namer.Name(key) }
+			groups[key] = of
+			files       = append(files, of)
+		}
+		of.add(idx)
+	}
+
+	return files
+}
+
+/*
+planBalanced: splits the records in files of roughly the same number of
+              bases, adding the largest records first to the smallest file
+*/
+func (m *splitMode) planBalanced(records []*fastaindex.IdxData, namer *outputNamer) (files []*outputFile) {
+	n := m.files
+	if n > len(records) {
+		n = len(records)
+	}
+
+	// files stay in creation order, the heap reorders bins
+	files = make([]*outputFile, n)
+	bins := make(fileHeap, n)
+	for i := range bins {
+		files[i] = &outputFile{ name: namer.Name(partName(i)) }
+		bins[i]  = files[i]
+	}
+
+	bySize := make([]*fastaindex.IdxData, len(records))
+	copy(bySize, records)
+	sort.SliceStable(bySize, func(i, j int) bool { return bySize[i].SeqSize > bySize[j].SeqSize })
+
+	heap.Init(&bins)
+	for _, idx := range bySize {
+		bins[0].add(idx)
+		heap.Fix(&bins, 0)
+	}
+
+	// records of each file back in file order
+	for _, of := range files {
+		sort.Slice(of.records, func(i, j int) bool { return of.records[i].SeqId < of.records[j].SeqId })
+	}
+
+	return files
+}
+
+
+// min heap of output files by number of bases
+type fileHeap []*outputFile
+
+func (h fileHeap)  Len() int            { return len(h) }
+func (h fileHeap)  Less(i, j int) bool  { return h[i].bases < h[j].bases }
+func (h fileHeap)  Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileHeap) Push(x interface{})  { *h = append(*h, x.(*outputFile)) }
+func (h *fileHeap) Pop() interface{} {
+	old := *h
+	x   := old[len(old)-1]
+	*h   = old[:len(old)-1]
+	return x
+}
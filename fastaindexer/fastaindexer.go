@@ -7,6 +7,8 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 )
@@ -30,6 +32,16 @@ var (
 )
 
 
+var format   string
+var validate bool
+var hash     bool
+func init() {
+	flag.StringVar(&format  , "format"  , fastaindex.FormatIdx, "index format: idx, fai")
+	flag.BoolVar  (&validate, "validate", false               , "only check the fasta file, printing a report of blank lines, data before the first header, empty headers and empty records")
+	flag.BoolVar  (&hash    , "hash"    , false               , "store the md5 of the fasta file in the index, so that it is not considered stale when only its modification time changes. idx format only")
+}
+
+
 /*
 main: checks if index exists, creating it otherwise, read index and create a go routine to read each sequence
 */
@@ -40,14 +52,65 @@ func main() {
 
 	log.Println("fastaindexer build:", Build)
 
-	argsWithoutProg := os.Args[1:]
+	flag.Parse()
+
+	argsWithoutProg := flag.Args()
 
 	if len(argsWithoutProg) != 1 {
 		log.Println("no argument or too many arguments given")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	fmatch := false
+	for _, fmt := range fastaindex.AvailableFormats {
+		if format == fmt {
+			fmatch = true
+			break
+		}
+	}
+
+	if ! fmatch {
+		flag.PrintDefaults()
+		log.Fatal("Invalid format: '" + format + "'")
+	}
+
 	filename        := argsWithoutProg[0]
 
-	fastaindex.CreateFastaIndex(filename)
+	if validate {
+		validateFasta(filename)
+		return
+	}
+
+	if err := fastaindex.CreateFastaIndexHashed(filename, format, hash); err != nil {
+		log.Fatal(err)
+	}
+}
+
+
+/*
+validateFasta: prints the problems found in a fasta file, one per line:
+               level, line, byte offset, class and sequence name.
+               exits with status 1 if the file cannot be indexed
+inputs       : filename string
+*/
+func validateFasta(filename string) {
+	issues, err := fastaindex.Validate(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fatal := false
+	for _, is := range issues {
+		fmt.Println(is.String())
+		if is.Fatal() {
+			fatal = true
+		}
+	}
+
+	log.Println("Validated", filename, "found", len(issues), "problems")
+
+	if fatal {
+		os.Exit(1)
+	}
 }
@@ -7,7 +7,7 @@ package main
 import (
 	"errors"
 	"fmt"
-//	"io"
+	"io"
 	"log"
 	"os"
 	"runtime"
@@ -16,6 +16,7 @@ import (
 
 import (
 	"github.com/sauloalgolang/fastareader/lib/fastaindex"
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
 	"github.com/sauloalgolang/fastareader/lib/fastatools"
 )
 
@@ -45,7 +46,56 @@ func check(e error) {
 
 
 /*
-main: checks if index exists, creating it otherwise, read index and create a go routine to read each sequence
+fetchRegions: prints the given samtools style regions (chr3:10000-20000) to stdout
+inputs      : filename string
+              regions  []string
+*/
+func fetchRegions(filename string, regions []string) {
+	index, err      := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
+	check(err)
+
+	for _, region := range regions {
+		reg, err := fastatools.ParseIndexRegion(index, region)
+		check(err)
+
+		seqd, err := fastatools.FetchRegion(filename, index, reg.SeqName, reg.Start, reg.End)
+		check(err)
+
+		seqd.SeqName = region
+		check(seqd.SaveToFasta(os.Stdout))
+	}
+}
+
+
+
+/*
+readStream: reads the sequences of a stream (stdin or pipe) or of a plain
+            gzip file sequentially
+inputs    : filename string
+*/
+func readStream(filename string) {
+	reader, err := fastatools.OpenReader(filename)
+	check(err)
+	defer reader.Close()
+
+	for {
+		seqd, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+
+		seqd.Print()
+	}
+
+	log.Println("Done")
+}
+
+
+
+/*
+main: checks if index exists, creating it otherwise, read index and create a go routine to read each sequence.
+      if regions are given, print them instead. streams ("-" for stdin) and plain gzip files are read sequentially
 */
 func main() {
 	if Build != "" {
@@ -55,14 +105,34 @@ func main() {
 
 	argsWithoutProg := os.Args[1:]
 
-        if len(argsWithoutProg) != 1 {
-                log.Println("no argument or too many arguments given")
+        if len(argsWithoutProg) < 1 {
+                log.Println("no argument given. usage: fastareader <in.fasta> [region1 [...]]")
                 os.Exit(1)
         }
 
 
         filename        := argsWithoutProg[0]
 
+	if fastaio.IsStream(filename) {
+		if len(argsWithoutProg) > 1 {
+			log.Fatal("regions can not be read from a stream")
+		}
+		readStream(filename)
+		return
+	}
+
+	if len(argsWithoutProg) > 1 {
+		fetchRegions(filename, argsWithoutProg[1:])
+		return
+	}
+
+	isSequential, err := fastaio.IsSequential(filename)
+	check(err)
+	if isSequential {
+		readStream(filename)
+		return
+	}
+
 	f, err := os.Open(filename)
 	check(err)
 	defer f.Close()
@@ -77,10 +147,13 @@ func main() {
 	log.Println("numCPU",numCPU)
 
 
-	idxData         := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
-	seqData         := make([]*fastatools.SeqData, len(*idxData))
+	index, err      := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
+	check(err)
+	log.Println("Sequences:", index.Len(), "Total size:", index.TotalSize())
+
+	seqData         := make([]*fastatools.SeqData, index.Len())
 
-	for _, idx := range *idxData {
+	for _, idx := range index.Records() {
 		idx.Print()
 	}
 
@@ -88,13 +161,14 @@ func main() {
 	log.Println("Reading File")
 	var limit  = make(chan int, numCPU)
 	var waiter = make(chan int)
-	for _, idx := range *idxData {
+	for _, idx := range index.Records() {
 		//idx.Print()
 
 		f := func (idx2 *fastaindex.IdxData) {
-			seqd := fastatools.ReadFastaSeq(filename, idx2.SeqPos)
+			seqd, err := fastatools.ReadFastaSeq(filename, idx2.SeqPos)
+			check(err)
 			log.Printf("RES: IDX: NAME '%s' ID %d SIZE %d POSITION %d FASTA: NAME '%s' SIZE %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos, seqd.SeqName, seqd.Size())
-			if (( idx2.SeqName != seqd.SeqName ) || (idx2.SeqSize != seqd.Size())) {
+			if (( ! idx2.MatchesName(seqd.SeqName) ) || (idx2.SeqSize != seqd.Size())) {
 				log.Fatal(fmt.Sprintf("Sequence mismatch. expexted '%s', found '%s'. Expected size %d, found %d", idx2.SeqName, seqd.SeqName, idx2.SeqSize, seqd.Size()))
 				os.Exit(1)
 			}
@@ -112,7 +186,7 @@ func main() {
 
 	log.Println("Waiting")
 
-	for i := 1; i <= len(*idxData); i++ {
+	for i := 1; i <= index.Len(); i++ {
 		<-waiter
 	}
 
@@ -0,0 +1,238 @@
+/*
+Package fastareformat rewrites a fasta file with a new line width and,
+optionally, changing the case of the bases
+*/
+
+package main
+
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaindex"
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+	"github.com/sauloalgolang/fastareader/lib/fastatools"
+)
+
+
+// http://www.golangbootcamp.com/book/tricks_and_tips
+// compile passing -ldflags "-X main.Build <build sha1>"
+var Build string
+
+
+// Error codes returned by failures to parse
+var (
+	ErrInternal   = errors.New("fastareformat: internal error"  )
+	ErrInvalidSeq = errors.New("fastareformat: invalid sequence")
+)
+
+
+// Bases read at a time from indexed files
+const readChunk = 1 << 20
+
+
+// temporary output file, removed on errors
+var tmpOut *os.File
+
+
+/*
+check: This helper will streamline our error checks below.
+       the temporary output file is removed before exiting
+src  : https://gobyexample.com/reading-files
+input: e error
+*/
+func check(e error) {
+        if e != nil {
+                if tmpOut != nil {
+                        fastaio.DiscardTemp(tmpOut)
+                }
+                log.Fatal( e )
+        }
+}
+
+
+var width   int
+var letters string
+var outFile string
+func init() {
+	flag.IntVar   (&width  , "width" , 60    , "bases per line. 0 for a single line per sequence")
+	flag.StringVar(&letters, "case"  , "keep", "case of the bases: keep, upper, lower")
+	flag.StringVar(&outFile, "out"   , "-"   , "output file. - for stdout")
+}
+
+
+/*
+changeCase: changes the case of the bases in place
+inputs    : seq []byte
+*/
+func changeCase(seq []byte) {
+	switch letters {
+	case "upper":
+		for i, b := range seq {
+			if b >= 'a' && b <= 'z' {
+				seq[i] = b - 'a' + 'A'
+			}
+		}
+	case "lower":
+		for i, b := range seq {
+			if b >= 'A' && b <= 'Z' {
+				seq[i] = b - 'A' + 'a'
+			}
+		}
+	}
+}
+
+
+
+/*
+reformatIndexed: rewrites the sequences of an indexed file in file order,
+                 reading large sequences in pieces
+inputs         : filename string
+                 fw       *fastatools.Writer
+outputs        : err      error
+*/
+func reformatIndexed(filename string, fw *fastatools.Writer) (err error) {
+	index, err := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
+	if err != nil {
+		return err
+	}
+
+	return index.Each(func(idx *fastaindex.IdxData) (err error) {
+		if err = fw.WriteHeader(idx.Header()); err != nil {
+			return err
+		}
+
+		// without a regular line layout the sequence is read at once
+		if ! idx.HasLineLayout() {
+			seqd, err := fastatools.ReadFastaSeq(filename, idx.SeqPos)
+			if err != nil {
+				return err
+			}
+			if seqd.Size() != idx.SeqSize {
+				return fmt.Errorf("%w: expected %d bases in '%s', found %d", ErrInvalidSeq, idx.SeqSize, idx.SeqName, seqd.Size())
+			}
+			changeCase(seqd.Sequence)
+			return fw.WriteSeq(seqd.Sequence)
+		}
+
+		for start := int64(0); start < idx.SeqSize; start += readChunk {
+			seqd, err := fastatools.FetchIdxRegion(filename, idx, start, start + readChunk)
+			if err != nil {
+				return err
+			}
+			changeCase(seqd.Sequence)
+			if err = fw.WriteSeq(seqd.Sequence); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+
+
+/*
+reformatStream: rewrites the sequences of a stream (stdin or pipe) or of a
+                plain gzip file, which can not be read at random
+                positions, reading them one by one
+inputs        : filename string
+                fw       *fastatools.Writer
+outputs       : err      error
+*/
+func reformatStream(filename string, fw *fastatools.Writer) (err error) {
+	reader, err := fastatools.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		seqd, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		changeCase(seqd.Sequence)
+		if err = fw.Write(seqd); err != nil {
+			return err
+		}
+	}
+}
+
+
+
+/*
+main: rewrites a fasta file, or stdin ("-"), to stdout or to a file
+*/
+func main() {
+	if Build == "" {
+		Build = "unset"
+	}
+
+	log.Println("fastareformat build:", Build)
+
+	flag.Parse()
+
+	argsWithoutProg := flag.Args()
+
+	if len(argsWithoutProg) != 1 {
+		log.Println("no argument or too many arguments given. usage: fastareformat [options] <in.fasta>")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if width < 0 {
+		flag.PrintDefaults()
+		log.Fatal("Line width (", width, ") must be greater or equal to 0")
+	}
+
+	if letters != "keep" && letters != "upper" && letters != "lower" {
+		flag.PrintDefaults()
+		log.Fatal("Invalid case: '" + letters + "'")
+	}
+
+	filename        := argsWithoutProg[0]
+
+	var out *os.File = os.Stdout
+	if outFile != "-" {
+		if outFile == filename {
+			log.Fatal("The output file can not be the input file")
+		}
+
+		fo, err := fastaio.CreateTemp(outFile)
+		check(err)
+		tmpOut   = fo
+		out      = fo
+	}
+
+	fw := fastatools.NewWriter(out, width)
+
+	isSequential, err := fastaio.IsSequential(filename)
+	check(err)
+
+	if isSequential {
+		check(reformatStream(filename, fw))
+	} else {
+		check(reformatIndexed(filename, fw))
+	}
+
+	check(fw.Flush())
+
+	if outFile != "-" {
+		tmpOut = nil
+		check(fastaio.CommitTemp(out, outFile))
+		log.Println("Saved to", outFile)
+	}
+}
@@ -8,14 +8,17 @@ import (
 	"errors"
 	"fmt"
 	"flag"
+	"io"
 	"log"
 	"os"
 	"runtime"
+	"sync"
 )
 
 
 import (
 	"github.com/sauloalgolang/fastareader/lib/fastaindex"
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
 	"github.com/sauloalgolang/fastareader/lib/fastatools"
 	"github.com/sauloalgolang/fastareader/lib/kmertools"
 )
@@ -50,6 +53,15 @@ var filename string
 var format   string
 var kmerSize int
 var threads  int
+var chunk    int64
+var minQual  int
+var mask     bool
+var mode     string
+var minCount int
+var maxCount int
+var sortBy   string
+var top      int
+var histoMax int
 func init() {
 	if Build != "" {
 		log.Println("kmerextracter build:", Build)
@@ -57,10 +69,19 @@ func init() {
 
 
 
-	flag.StringVar(&filename, "filename",      "", "input fasta")
-	flag.StringVar(&format  , "format"  , "fasta", "format: fasta, csv, list" )
+	flag.StringVar(&filename, "filename",      "", "input fasta or fastq, optionally gzipped. - for stdin")
+	flag.StringVar(&format  , "format"  , "fasta", "format: fasta, csv, list, histo (count spectrum, with a summary of the coverage and genome size), db (binary, sorted by kmer, for kmerquery)" )
 	flag.IntVar(   &kmerSize, "kmersize",       0, "kmer size"  )
 	flag.IntVar(   &threads , "threads" ,       0, "number of threads. 0 for max"  )
+	flag.Int64Var( &chunk   , "chunk"   , 10000000, "split sequences longer than this many bases in chunks counted in parallel. 0 to disable")
+	flag.IntVar(   &minQual , "minqual" ,       0, "fastq: minimum phred base quality. 0 to disable")
+	flag.BoolVar(  &mask    , "mask"    ,    true, "fastq: mask bases below minqual, breaking kmers as N does. if false, skip reads with any base below minqual")
+	flag.StringVar(&mode    , "mode"    , kmertools.ModeCanonical, "counting mode: canonical (smaller of kmer and reverse complement), forward (kmers as read, for stranded data), both (as canonical, counting each strand separately. csv has a forward and a reverse column)")
+	flag.IntVar(   &minCount, "mincount",       0, "save only kmers counted at least this many times. 0 for no limit")
+	flag.IntVar(   &maxCount, "maxcount",       0, "save only kmers counted at most this many times. 0 for no limit")
+	flag.StringVar(&sortBy  , "sort"    , kmertools.SortNone, "order of the saved kmers: none (changes between runs, needs no extra memory), kmer (lexicographic), count (decreasing count). sorting copies the saved kmers")
+	flag.IntVar(   &top     , "top"     ,       0, "save only the first kmers of the order. 0 for all")
+	flag.IntVar(   &histoMax, "histomax", kmertools.DefaultHistoMax, "histo: last count of the spectrum. higher counts are added to it")
 	flag.Parse()
 
 
@@ -70,27 +91,29 @@ func init() {
                 log.Fatal("No input file given\n")
 	}
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		flag.PrintDefaults()
-                log.Fatal("Input file '" + filename + "' does not exist\n")
-	}
+	if filename != "-" {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			flag.PrintDefaults()
+	                log.Fatal("Input file '" + filename + "' does not exist\n")
+		}
 
-	fi, err := os.Open(filename)
-	check(err)
-	//defer fi.Close()
+		fi, err := os.Open(filename)
+		check(err)
+		//defer fi.Close()
 
-	st, err := fi.Stat()
-	check(err)
-	//log.Print(d)
+		st, err := fi.Stat()
+		check(err)
+		//log.Print(d)
 
-	// http://stackoverflow.com/questions/8824571/golang-determining-whether-file-points-to-file-or-directory
-	switch mode := st.Mode(); {
-		case mode.IsDir():
-			// do directory stuff
-			flag.PrintDefaults()
-			log.Fatal("File '"+filename+"' is a directory\n")
+		// http://stackoverflow.com/questions/8824571/golang-determining-whether-file-points-to-file-or-directory
+		switch mode := st.Mode(); {
+			case mode.IsDir():
+				// do directory stuff
+				flag.PrintDefaults()
+				log.Fatal("File '"+filename+"' is a directory\n")
+		}
+		fi.Close()
 	}
-	fi.Close()
 
 
 
@@ -120,6 +143,70 @@ func init() {
 		log.Fatal("No kmer size set\n")
 	}
 
+	mmatch := false
+	for _, m := range kmertools.AvailableModes {
+		if mode == m {
+			mmatch = true
+			break
+		}
+	}
+
+	if ! mmatch {
+		flag.PrintDefaults()
+		log.Fatal("Invalid counting mode: '" + mode + "'")
+	}
+
+
+
+	smatch := false
+	for _, s := range kmertools.AvailableSorts {
+		if sortBy == s {
+			smatch = true
+			break
+		}
+	}
+
+	if ! smatch {
+		flag.PrintDefaults()
+		log.Fatal("Invalid sort order: '" + sortBy + "'")
+	}
+
+	if minCount < 0 || maxCount < 0 || top < 0 {
+		flag.PrintDefaults()
+		log.Fatal("Count limits and top (",minCount,maxCount,top,") must be greater or equal to 0\n")
+	}
+
+	if maxCount > 0 && maxCount < minCount {
+		flag.PrintDefaults()
+		log.Fatal("Maximum count (",maxCount,") smaller than minimum count (",minCount,")\n")
+	}
+
+	if format == "db" && (sortBy == kmertools.SortCount || top > 0) {
+		flag.PrintDefaults()
+		log.Fatal("Kmer databases are sorted by kmer. sort by count and top are not supported\n")
+	}
+
+
+
+	if histoMax < 1 {
+		flag.PrintDefaults()
+		log.Fatal("Histogram maximum count (",histoMax,") must be greater than 0\n")
+	}
+
+
+
+	if minQual < 0 {
+		flag.PrintDefaults()
+		log.Fatal("Minimum quality (",minQual,") must be greater or equal to 0\n")
+	}
+
+
+
+	if chunk < 0 {
+		flag.PrintDefaults()
+		log.Fatal("Chunk size (",chunk,") must be greater or equal to 0\n")
+	}
+
 
 
 	var numCPU = runtime.GOMAXPROCS(0)
@@ -141,17 +228,225 @@ func init() {
 
 
 /*
-main: checks if index exists, creating it otherwise, read index and create a go routine to read each sequence
+extractChunks: counts the kmers of a long sequence in parallel, splitting
+               it in chunks of chunk+kmerSize-1 bases, so that every kmer
+               starts in exactly one chunk. chunks are read seeking
+               through the index
+inputs       : idx    *fastaindex.IdxData
+               limit  chan int
+               waiter chan int - receives one message per chunk
+               data   *kmertools.Data
+outputs      : number of chunks
+*/
+func extractChunks(idx *fastaindex.IdxData, limit chan int, waiter chan int, data *kmertools.Data) (chunks int) {
+	overlap := int64(kmerSize - 1)
+
+	for start := int64(0); start < idx.SeqSize; start += chunk {
+		end := start + chunk + overlap
+		if end > idx.SeqSize {
+			end = idx.SeqSize
+		}
+
+		go func(start int64, end int64) {
+			limit <- 1
+
+			log.Printf("READING: IDX: NAME '%s' ID %d CHUNK %d-%d\n", idx.SeqName, idx.SeqId, start, end)
+
+			seqd, err := fastatools.FetchIdxRegion(filename, idx, start, end)
+			check(err)
+
+			check(kmertools.ExtractKmers(seqd, kmerSize, data))
+
+			log.Printf("READ   : IDX: NAME '%s' ID %d CHUNK %d-%d\n", idx.SeqName, idx.SeqId, start, end)
+
+			<-limit
+			waiter <- 1
+		}(start, end)
+
+		chunks++
+	}
+
+	return chunks
+}
+
+
+
+/*
+extractStream: counts the kmers of a stream (stdin or pipe), of a plain
+               gzip file or of a fastq file, reading its sequences
+               sequentially and counting them in threads workers. at most
+               twice threads sequences are held in memory
+inputs       : data *kmertools.Data
+*/
+func extractStream(data *kmertools.Data) {
+	reader, err := fastatools.OpenReader(filename)
+	check(err)
+	defer reader.Close()
+
+	reads       := make(chan *fastatools.SeqData, threads)
+	var wg sync.WaitGroup
+
+	// each worker keeps its extractor, flushed once at the end
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ex, err := data.NewExtractor()
+			check(err)
+
+			for seqd := range reads {
+				if minQual > 0 && seqd.Quality != nil {
+					if mask {
+						seqd.MaskLowQuality(minQual)
+					} else
+					if seqd.CountLowQuality(minQual) > 0 {
+						continue
+					}
+				}
+
+				check(ex.Extract(seqd.Sequence, seqd.SeqName))
+			}
+
+			check(ex.Flush())
+		}()
+	}
+
+	for {
+		seqd, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+
+		reads <- seqd
+	}
+
+	close(reads)
+	wg.Wait()
+}
+
+
+
+/*
+save  : saves the kmers counted
+inputs: prefix string - prefix of the output file
+        data   *kmertools.Data
+*/
+func save(prefix string, data *kmertools.Data) {
+	log.Println("Done Counting")
+
+
+	log.Println("Kmers Total ", data.Total)
+	log.Println("Kmers Unique", data.Len())
+
+
+	outFileName     := fmt.Sprintf("%s_%d.kmers.%s", prefix, kmerSize, format)
+	if mode != kmertools.ModeCanonical {
+		outFileName  = fmt.Sprintf("%s_%d_%s.kmers.%s", prefix, kmerSize, mode, format)
+	}
+	log.Println("Saving to", outFileName)
+
+	if format == "histo" {
+		saveHisto(outFileName, data)
+		log.Println("Done")
+		return
+	}
+
+	data.Sources     = []string{ filename }
+
+	opts            := kmertools.SaveOptions{ MinCount: minCount, MaxCount: maxCount, Sort: sortBy, Top: top }
+	check(data.SaveAsWith(outFileName, format, opts))
+
+
+	log.Println("Done")
+}
+
+
+
+/*
+saveHisto: saves the count spectrum and a summary of the estimates derived
+           from it
+inputs   : outFileName string
+           data        *kmertools.Data
+creates  : outFileName, outFileName.summary.tsv
+*/
+func saveHisto(outFileName string, data *kmertools.Data) {
+	h, err := data.Histogram(histoMax)
+	check(err)
+	check(h.SaveAs(outFileName))
+
+	summary, err := h.Summary()
+	if errors.Is(err, kmertools.ErrNoPeak) {
+		log.Println("No summary:", err)
+		return
+	}
+	check(err)
+
+	summary.Log()
+
+	sumFileName := outFileName + ".summary.tsv"
+	fo, err     := fastaio.CreateTemp(sumFileName)
+	check(err)
+	if err = summary.Write(fo); err != nil {
+		fastaio.DiscardTemp(fo)
+		check(err)
+	}
+	check(fastaio.CommitTemp(fo, sumFileName))
+
+	log.Println("Summary saved to", sumFileName)
+}
+
+
+
+/*
+main: checks if index exists, creating it otherwise, read index and create a go routine to read each sequence.
+      streams ("-" for stdin) and plain gzip files are read sequentially, without index
 */
 func main() {
+	// streams can only be read once, so they are not checked for fastq
+	isStream     := fastaio.IsStream(filename)
+	isFastq      := false
+	if ! isStream {
+		var err error
+		isFastq, err = fastatools.IsFastq(filename)
+		check(err)
+	}
+
+	isSequential, err := fastaio.IsSequential(filename)
+	check(err)
+
+	if isSequential || isFastq {
+		log.Println("Reading Stream")
+
+		data := new( kmertools.Data )
+		check(data.NewMode(kmerSize, mode))
+
+		extractStream(data)
+
+		prefix := filename
+		if filename == "-" {
+			prefix = "stdin"
+		}
+		save(prefix, data)
+		return
+	}
+
 	log.Println("Reading Index")
 
 
-	idxData         := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
-	//seqData         := make([]*fastatools.SeqData, len(*idxData))
+	if minQual > 0 {
+		log.Println("Input is fasta. ignoring minimum quality")
+	}
+
+	index, err      := fastaindex.ReadFastaIndexCreatingIfNotExists(filename)
+	check(err)
+	log.Println("Sequences:", index.Len(), "Total size:", index.TotalSize())
+	//seqData         := make([]*fastatools.SeqData, index.Len())
 
 
-	for _, idx := range *idxData {
+	for _, idx := range index.Records() {
 		idx.Print()
 	}
 
@@ -162,29 +457,49 @@ func main() {
 	waiter          := make(chan int         )
 	//data            := make(map[string]int   )
 	data            := new( kmertools.Data )
-	data.New(kmerSize)
+	check(data.NewMode(kmerSize, mode))
+	tasks           := 0
 
-	for _, idx := range *idxData {
+	for _, idx := range index.Records() {
+		if chunk != 0 && idx.HasLineLayout() && idx.SeqSize > chunk {
+			tasks += extractChunks(idx, limit, waiter, data)
+			continue
+		}
+
+		tasks++
 		//idx.Print()
 
 		f := func (idx2 *fastaindex.IdxData) {
 			if ( load_all ) {
-				seqd := fastatools.ReadFastaSeq(filename, idx2.SeqPos)
+				seqd, err := fastatools.ReadFastaSeq(filename, idx2.SeqPos)
+				check(err)
 
 				log.Printf("RES: IDX: NAME '%s' ID %d SIZE %d POSITION %d FASTA: NAME '%s' SIZE %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos, seqd.SeqName, seqd.Size())
 
-				if (( idx2.SeqName != seqd.SeqName ) || (idx2.SeqSize != seqd.Size())) {
+				if (( ! idx2.MatchesName(seqd.SeqName) ) || (idx2.SeqSize != seqd.Size())) {
 					log.Fatal(fmt.Sprintf("Sequence mismatch. expexted '%s', found '%s'. Expected size %d, found %d", idx2.SeqName, seqd.SeqName, idx2.SeqSize, seqd.Size()))
 					os.Exit(1)
 				}
 
 				//seqData[idx2.SeqId - 1] = seqd
-				kmertools.ExtractKmers(seqd, kmerSize, data)
+				check(kmertools.ExtractKmers(seqd, kmerSize, data))
 
 				seqd.Sequence = make([]byte,0)
 			} else {
 				log.Printf("READING: IDX: NAME '%s' ID %d SIZE %d POSITION %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos)
-				fastatools.ReadFastaSeqIter(filename, idx2.SeqPos, kmertools.GetExtractKmersIterClbk( kmerSize, data ))
+				reader, err := fastatools.OpenReaderAt(filename, idx2.SeqPos)
+				check(err)
+
+				seqd, err := reader.NextHeader()
+				check(err)
+				if ! idx2.MatchesName(seqd.SeqName) {
+					log.Fatal(fmt.Sprintf("Sequence mismatch. expexted '%s', found '%s'", idx2.SeqName, seqd.SeqName))
+				}
+
+				batch := data.NewBatch()
+				check(kmertools.ExtractKmersFromLines(reader, seqd.SeqName, kmerSize, batch))
+				check(batch.Flush())
+				check(reader.Close())
 				log.Printf("READ   : IDX: NAME '%s' ID %d SIZE %d POSITION %d\n", idx2.SeqName, idx2.SeqId, idx2.SeqSize, idx2.SeqPos)
 			}
 
@@ -203,25 +518,12 @@ func main() {
 	log.Println("Waiting")
 
 
-	for i := 1; i <= len(*idxData); i++ {
+	for i := 1; i <= tasks; i++ {
 		<-waiter
 	}
 
 
-	log.Println("Done Counting")
-
-
-	log.Println("Kmers Total ", data.Total)
-	log.Println("Kmers Unique", data.Len())
-
-
-	outFileName     := fmt.Sprintf("%s_%d.kmers.%s", filename, kmerSize, format)
-	log.Println("Saving to", outFileName)
-
-	data.SaveAs(outFileName, format)
-
-
-	log.Println("Done")
+	save(filename, data)
 
 	/*
 	for _, seq := range seqData {
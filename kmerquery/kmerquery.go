@@ -0,0 +1,198 @@
+/*
+Package kmerquery looks up kmers in a kmer database saved by kmerextractor
+with -format db, reading only the records it needs
+*/
+
+package main
+
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastatools"
+	"github.com/sauloalgolang/fastareader/lib/kmertools"
+)
+
+
+// http://www.golangbootcamp.com/book/tricks_and_tips
+// compile passing -ldflags "-X main.Build <build sha1>"
+var Build string
+
+
+/*
+check: This helper will streamline our error checks below.
+src  : https://gobyexample.com/reading-files
+input: e error
+*/
+func check(e error) {
+        if e != nil {
+                log.Fatal( e )
+        }
+}
+
+
+var dbFile    string
+var fastaFile string
+var summary   bool
+func init() {
+	flag.StringVar(&dbFile   , "db"     , ""   , "kmer database, saved by kmerextractor -format db")
+	flag.StringVar(&fastaFile, "fasta"  , ""   , "look up all the kmers of the sequences of a fasta or fastq file. - for stdin")
+	flag.BoolVar  (&summary  , "summary", false, "fasta: one line per sequence with the number of kmers, those found and their mean count, instead of one line per kmer")
+}
+
+
+/*
+queryKmers: prints the count of each kmer given, followed, for databases of
+            mode both, by the times the kmer and its reverse complement were
+            read
+inputs    : db    *kmertools.KmerDB
+            kmers []string
+            out   io.Writer
+outputs   : err   error
+*/
+func queryKmers(db *kmertools.KmerDB, kmers []string, out io.Writer) (err error) {
+	for _, kmer := range kmers {
+		if db.Mode == kmertools.ModeBoth {
+			fwd, rev, err := db.LookupStrands(kmer)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(out, "%s\t%d\t%d\t%d\n", kmer, fwd + rev, fwd, rev); err != nil {
+				return err
+			}
+			continue
+		}
+
+		count, err := db.Lookup(kmer)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(out, "%s\t%d\n", kmer, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+/*
+querySeqs: prints the count of every kmer of the sequences of a file, as
+           "name<tab>position<tab>kmer<tab>count", position 1 based, or a
+           line per sequence with -summary
+inputs   : db       *kmertools.KmerDB
+           filename string
+           out      io.Writer
+outputs  : err      error
+*/
+func querySeqs(db *kmertools.KmerDB, filename string, out io.Writer) (err error) {
+	reader, err := fastatools.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if summary {
+		_, err = fmt.Fprintln(out, "#name\tkmers\tfound\tmean_count")
+	} else {
+		_, err = fmt.Fprintln(out, "#name\tposition\tkmer\tcount")
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		seqd, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		kmers := 0
+		found := 0
+		total := 0
+
+		err = db.QuerySeq(seqd.Sequence, func(pos int, count int) (err error) {
+			kmers++
+			total += count
+			if count > 0 {
+				found++
+			}
+
+			if ! summary {
+				_, err = fmt.Fprintf(out, "%s\t%d\t%s\t%d\n", seqd.SeqName, pos + 1, seqd.Sequence[pos:pos + db.KmerSize], count)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", seqd.SeqName, err)
+		}
+
+		if summary {
+			mean := 0.0
+			if kmers > 0 {
+				mean = float64(total) / float64(kmers)
+			}
+			if _, err = fmt.Fprintf(out, "%s\t%d\t%d\t%.2f\n", seqd.SeqName, kmers, found, mean); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+
+
+/*
+main: opens the database and looks up the kmers given as arguments, or
+      those of the sequences of -fasta, printing their counts to stdout
+*/
+func main() {
+	if Build == "" {
+		Build = "unset"
+	}
+
+	log.Println("kmerquery build:", Build)
+
+	flag.Parse()
+
+	kmers := flag.Args()
+
+	if dbFile == "" {
+		flag.PrintDefaults()
+		log.Fatal("No database given")
+	}
+
+	if (len(kmers) == 0) == (fastaFile == "") {
+		log.Println("give either kmers or -fasta. usage: kmerquery -db <db> <kmer>... | kmerquery -db <db> -fasta <in.fasta>")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	db, err := kmertools.OpenKmerDB(dbFile)
+	check(err)
+	defer db.Close()
+
+	log.Println("Kmer size", db.KmerSize, "mode", db.Mode, "kmers", db.Kmers, "sources", db.Sources)
+
+	out     := bufio.NewWriter(os.Stdout)
+
+	if fastaFile != "" {
+		err  = querySeqs(db, fastaFile, out)
+	} else {
+		err  = queryKmers(db, kmers, out)
+	}
+
+	if err == nil {
+		err  = out.Flush()
+	}
+	check(err)
+}
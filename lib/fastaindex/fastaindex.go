@@ -5,14 +5,20 @@ Package fastaindex contains routines to work with fasta file indexes
 package fastaindex
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
-//	"io"
+	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"unicode"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
 )
 
 // Error codes returned by failures to parse
@@ -22,63 +28,303 @@ var (
         ErrInvalidIdx = errors.New("fastareader: invalid index file")
 )
 
+// Index formats. The format name is also the extension of the index file
+const (
+	FormatIdx = "idx" // native format: name, id, size, header position, first base position, line bases, line width
+	FormatFai = "fai" // samtools faidx: name, length, offset, line bases, line width
+)
+
+// Available index formats
+var AvailableFormats = [2]string{ FormatIdx, FormatFai }
 
+type IdxData struct {
+	SeqName   string // first word of the header
+	SeqDesc   string // rest of the header
+	SeqId     int
+	SeqSize   int64
+	SeqPos    int64 // position of the header line
+	SeqOffset int64 // position of the first base
+	LineBases int64 // bases per line. 0 if lines are irregular
+	LineWidth int64 // bytes per line, including the line terminator
+}
+
+func (idx *IdxData) Print () {
+	log.Printf("IDX: NAME '%s' DESC '%s' ID %d SIZE %d POSITION %d OFFSET %d LINE BASES %d LINE WIDTH %d\n", idx.SeqName, idx.SeqDesc, idx.SeqId, idx.SeqSize, idx.SeqPos, idx.SeqOffset, idx.LineBases, idx.LineWidth)
+}
 
 /*
-check: This helper will streamline our error checks below.
-src  : https://gobyexample.com/reading-files
-input: e error
+Header : the header line, without '>'
+outputs: string
 */
-func check(e error) {
-	if e != nil {
-		log.Fatal( e )
-		panic(e)
+func (idx *IdxData) Header() string {
+	return JoinHeader(idx.SeqName, idx.SeqDesc)
+}
+
+func (idx *IdxData) Write (file *os.File) (err error) {
+	log.Println("Writing IDX")
+	_, err = fmt.Fprintf(file, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", idx.SeqName, idx.SeqId, idx.SeqSize, idx.SeqPos, idx.SeqOffset, idx.LineBases, idx.LineWidth, idx.SeqDesc)
+	return err
+}
+
+func (idx *IdxData) Read (line string) (err error) {
+	// the description is the last column and may contain tabs
+	cols        := strings.SplitN(line, "\t", 8)
+
+	//log.Println(cols, len(cols))
+
+	// indexes created before the line layout was recorded have 4 columns,
+	// and before the description was split from the name, 7
+	if len(cols) != 4 && len(cols) != 7 && len(cols) != 8 {
+		return fmt.Errorf("%w: expected 4, 7 or 8 columns, found %d", ErrInvalidIdx, len(cols))
+	}
+
+	if len(cols) == 8 {
+		idx.SeqName = cols[0]
+		idx.SeqDesc = cols[7]
+	} else {
+		idx.SeqName, idx.SeqDesc = SplitHeader(cols[0])
+	}
+
+	idx.SeqId, err = strconv.Atoi(cols[1])
+	if err != nil {
+		return fmt.Errorf("%w: column 2: %w", ErrInvalidIdx, err)
 	}
+
+	if len(cols) == 4 {
+		return parseCols(cols[2:], &idx.SeqSize, &idx.SeqPos)
+	}
+
+	return parseCols(cols[2:7], &idx.SeqSize, &idx.SeqPos, &idx.SeqOffset, &idx.LineBases, &idx.LineWidth)
 }
 
-type IdxData struct {
-	SeqName string
-	SeqId   int
-	SeqSize int64
-	SeqPos  int64
+/*
+HasLineLayout: checks whether the line layout of the record is known,
+               which is required for random access inside the sequence
+outputs      : bool
+*/
+func (idx *IdxData) HasLineLayout() bool {
+	return idx.LineBases > 0 && idx.LineWidth >= idx.LineBases
 }
 
-func (idx *IdxData) Print () {
-	log.Printf("IDX: NAME '%s' ID %d SIZE %d POSITION %d\n", idx.SeqName, idx.SeqId, idx.SeqSize, idx.SeqPos)
+/*
+BaseOffset: position in the file of a base of the sequence
+inputs    : pos int64 - 0-based position in the sequence
+outputs   : int64
+*/
+func (idx *IdxData) BaseOffset(pos int64) int64 {
+	return idx.SeqOffset + (pos / idx.LineBases) * idx.LineWidth + pos % idx.LineBases
 }
 
-func (idx *IdxData) Write (file *os.File) {
-	log.Println("Writing IDX")
-	fmt.Fprintf(file, "%s\t%d\t%d\t%d\n", idx.SeqName, idx.SeqId, idx.SeqSize, idx.SeqPos)
+/*
+WriteFai: writes the record as a samtools faidx line
+input   : file *os.File
+output  : err  error
+*/
+func (idx *IdxData) WriteFai (file *os.File) (err error) {
+	log.Println("Writing FAI")
+	_, err = fmt.Fprintf(file, "%s\t%d\t%d\t%d\t%d\n", idx.SeqName, idx.SeqSize, idx.SeqOffset, idx.LineBases, idx.LineWidth)
+	return err
 }
 
-func (idx *IdxData) Read (line string) {
-	cols        := strings.Split(line, "\t")
+/*
+ReadFai: parses a samtools faidx line.
+         SeqPos and SeqDesc are not part of the format and are left untouched
+input  : line string
+output : err  error
+*/
+func (idx *IdxData) ReadFai (line string) (err error) {
+	cols          := strings.Split(line, "\t")
 
-	//log.Println(cols, len(cols))
+	if len(cols) != 5 {
+		return fmt.Errorf("%w: expected 5 columns, found %d", ErrInvalidIdx, len(cols))
+	}
+
+	idx.SeqName = cols[0]
+
+	return parseCols(cols[1:], &idx.SeqSize, &idx.SeqOffset, &idx.LineBases, &idx.LineWidth)
+}
+
+/*
+parseCols: parses index columns as integers
+inputs   : cols []string
+           dst  ...*int64 - one destination per column
+outputs  : err  error
+*/
+func parseCols(cols []string, dst ...*int64) (err error) {
+	for i, d := range dst {
+		if *d, err = strconv.ParseInt(cols[i], 10, 64); err != nil {
+			return fmt.Errorf("%w: column '%s': %w", ErrInvalidIdx, cols[i], err)
+		}
+	}
+	return nil
+}
 
-	idx.SeqName   =                  cols[0]
-	idx.SeqId  ,_ = strconv.Atoi(    cols[1]        )
-	idx.SeqSize,_ = strconv.ParseInt(cols[2], 10, 64)
-	idx.SeqPos ,_ = strconv.ParseInt(cols[3], 10, 64)
+/*
+seqBytes: number of bytes taken by the sequence lines of a record,
+          not counting the terminator of the last line
+outputs : int64
+*/
+func (idx *IdxData) seqBytes() int64 {
+	if idx.LineBases == 0 {
+		return 0
+	}
+	return (idx.SeqSize / idx.LineBases) * idx.LineWidth + idx.SeqSize % idx.LineBases
 }
 
+/*
+MatchesName: checks whether a sequence name belongs to this record.
+             the name may be the id or the whole header
+inputs     : name string
+outputs    : bool
+*/
+func (idx *IdxData) MatchesName(name string) bool {
+	id, _ := SplitHeader(name)
+	return idx.SeqName == id
+}
+
+/*
+SplitHeader: splits a header line, without '>', into the sequence id, its
+             first word, and the description, the rest of the line
+inputs     : header string
+outputs    : name   string
+             desc   string
+*/
+func SplitHeader(header string) (name string, desc string) {
+	header = strings.TrimSpace(header)
 
+	i := strings.IndexFunc(header, unicode.IsSpace)
+	if i == -1 {
+		return header, ""
+	}
+
+	return header[:i], strings.TrimSpace(header[i:])
+}
 
 /*
-CreateFastaIndexIfNotExists: create fasta index if it does not exists already
+JoinHeader: header line, without '>', of an id and a description
+inputs    : name string
+            desc string
+outputs   : string
+*/
+func JoinHeader(name string, desc string) string {
+	if desc == "" {
+		return name
+	}
+	return name + " " + desc
+}
+
+/*
+IndexName: name of the index file of a fasta file in a given format
+inputs   : filename string
+           format   string
+outputs  : string
+*/
+func IndexName(filename string, format string) string {
+	return filename + "." + format
+}
+
+/*
+FindFastaIndex: returns the format of the first existing index of a fasta file.
+                the native format has precedence over faidx
+inputs        : filename string
+outputs       : format   string
+                found    bool
+*/
+func FindFastaIndex(filename string) (format string, found bool) {
+	for _, format := range AvailableFormats {
+		if _, err := os.Stat(IndexName(filename, format)); err == nil {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+
+
+/*
+CreateFastaIndexIfNotExists: create fasta index if it does not exists already.
+                             an index older than the fasta file is recreated
+                             in the same format. processes creating the
+                             same index wait for the first one to finish
 inputs                     : filename string
+outputs                    : err      error
 creates                    : filename.idx
 */
-func CreateFastaIndexIfNotExists(filename string) {
-	idxName    := filename+".idx"
+func CreateFastaIndexIfNotExists(filename string) (err error) {
+	format, hash, ok, err := checkExistingIndex(filename, false)
+	if err != nil || ok {
+		return err
+	}
+
+	lock, err := lockIndex(filename)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// another process may have created it while we waited for the lock
+	format, hash, ok, err = checkExistingIndex(filename, true)
+	if err != nil || ok {
+		return err
+	}
 
-        if _, err := os.Stat(idxName); os.IsNotExist(err) {
-                log.Println("Index does not exists. creating")
-                CreateFastaIndex(filename)
-        } else {
-                log.Println("Index alread exists")
-        }
+	return createFastaIndex(filename, format, hash)
+}
+
+/*
+checkExistingIndex: checks whether the index of a fasta file exists and is
+                    up to date, updating its header if the fasta file only
+                    changed its modification time
+inputs            : filename string
+                    locked   bool   - the index lock is already held
+outputs           : format   string - format to create the index in
+                    hash     bool   - whether the md5 should be stored
+                    ok       bool   - the index can be used
+                    err      error
+*/
+func checkExistingIndex(filename string, locked bool) (format string, hash bool, ok bool, err error) {
+	format, found := FindFastaIndex(filename)
+	if ! found {
+		log.Println("Index does not exists. creating")
+		return FormatIdx, false, false, nil
+	}
+
+	if ! locked {
+		log.Println("Index alread exists. format:", format)
+	}
+
+	stored, cur, err := checkSource(filename, format)
+	if errors.Is(err, ErrStaleIdx) {
+		if ! locked {
+			log.Println("Index is stale. recreating:", err)
+		}
+		return format, stored != nil && stored.Md5 != "", false, nil
+	}
+	if err != nil {
+		return "", false, false, err
+	}
+
+	if cur != nil {
+		updateSourceInfo(filename, stored, cur, locked)
+	}
+
+	return format, false, true, nil
+}
+
+/*
+lockIndex: acquires the lock held while the indexes of a fasta file are
+           created
+inputs   : filename string
+outputs  : *fastaio.FileLock
+           error
+creates  : filename.lock
+*/
+func lockIndex(filename string) (*fastaio.FileLock, error) {
+	lock, err := fastaio.Lock(filename + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+	return lock, nil
 }
 
 
@@ -86,64 +332,207 @@ func CreateFastaIndexIfNotExists(filename string) {
 /*
 CreateFastaIndex: index a fasta file
 input           : filename string
+output          : err      error
 creates         : filename.idx
 */
-func CreateFastaIndex(filename string) {
-        fi, err := os.Open(filename)
-	check(err)
+func CreateFastaIndex(filename string) (err error) {
+	return CreateFastaIndexAs(filename, FormatIdx)
+}
+
+
+
+/*
+CreateFastaIndexAs: index a fasta file in a given format. positions refer
+                    to the uncompressed data of gzip and bgzf files
+input             : filename string
+                    format   string
+output            : err      error
+creates           : filename.idx or filename.fai. filename.gzi for bgzf files
+*/
+func CreateFastaIndexAs(filename string, format string) (err error) {
+	return CreateFastaIndexHashed(filename, format, false)
+}
+
+
+
+/*
+CreateFastaIndexHashed: index a fasta file in a given format. the native
+                        index starts with the size, modification time and,
+                        if hash is set, the md5 of the fasta file
+input                 : filename string
+                        format   string
+                        hash     bool
+output                : err      error
+creates               : filename.idx or filename.fai. filename.gzi for bgzf files
+*/
+func CreateFastaIndexHashed(filename string, format string, hash bool) (err error) {
+	lock, err := lockIndex(filename)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return createFastaIndex(filename, format, hash)
+}
+
+/*
+createFastaIndex: CreateFastaIndexHashed, with the lock already held
+*/
+func createFastaIndex(filename string, format string, hash bool) (err error) {
+	if format != FormatIdx && format != FormatFai {
+		return fmt.Errorf("%w: unknown index format '%s'", ErrInvalidIdx, format)
+	}
+
+	// before reading, so that changes while indexing make the index stale
+	si, err := StatSource(filename, hash)
+	if err != nil {
+		return err
+	}
+
+        fi, err := fastaio.Open(filename)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidFa, err)
+	}
 	defer fi.Close()
 
-        _, err   = fi.Stat()
-	check(err)
+	if fi.Kind == fastaio.KindGzip {
+		log.Println("File", filename, "is gzip but not bgzf compressed. random access will decompress from the start. consider using bgzip")
+	}
+
+	if fi.Kind == fastaio.KindBgzf {
+		if err := fastaio.CreateGzi(filename); err != nil {
+			return err
+		}
+	}
 
 	//log.Println(d)
 
 	// open output file
-	idxName    := filename+".idx"
-	idxNameTmp := idxName + ".tmp"
-	fo, err    := os.Create(idxNameTmp)
-	check(err)
-	defer func() {
-		os.Remove(idxNameTmp)
-	}()
-	defer fo.Close()
-
-	scanner  := bufio.NewScanner(fi)
-	scanner.Split(bufio.ScanLines)
+	idxName    := IndexName(filename, format)
+	fo, err    := fastaio.CreateTemp(idxName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+	defer fastaio.DiscardTemp(fo)
+
+	if format == FormatIdx {
+		if err := si.Write(fo); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+		}
+	}
+
+	lr       := fastaio.NewLineReader(fi)
 
 	idx      := new(IdxData)
-	position := 0
+	position := int64(0)
+	lineNum  := 0
+	lineEnd  := false // a line shorter than the line width was seen
+	regular  := true  // all lines, but the last, have the same length
+
+	write    := func() (err error) {
+		if ! regular {
+			if format == FormatFai {
+				return fmt.Errorf("%w: %s:%d: different line lengths in sequence '%s'", ErrInvalidFa, filename, lineNum, idx.SeqName)
+			}
+			idx.LineBases = 0
+			idx.LineWidth = 0
+		}
+		idx.Print()
+		if format == FormatFai {
+			err = idx.WriteFai(fo)
+		} else {
+			err = idx.Write(fo)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+		}
+		return nil
+	}
 
-	for scanner.Scan() {
-		line     := scanner.Text()
-		position += len(line) + 1
+	for {
+		line, size, err := lr.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s:%d: %w", ErrInvalidFa, filename, lineNum + 1, err)
+		}
 
-		if line[0] == byte('>') {
+		// size includes the line ending, "\n" or "\r\n"
+		position += int64(size)
+		lineNum   = lr.LineNum
+
+		if len(line) != 0 && line[0] == byte('>') {
 			if idx.SeqName != "" {
-				idx.Print()
-				idx.Write(fo)
+				if err := write(); err != nil {
+					return err
+				}
+			}
+
+			idx.SeqPos    = position - int64(size)
+			idx.SeqOffset = position
+			idx.SeqName, idx.SeqDesc = SplitHeader(string(line[1:]))
+			idx.SeqId    += 1
+
+			if idx.SeqName == "" {
+				return fmt.Errorf("%w: %s:%d: offset %d: %s", ErrInvalidFa, filename, lineNum, idx.SeqPos, IssueEmptyHeader)
 			}
 
-			idx.SeqPos   = int64(position - len(line) - 1)
-			idx.SeqName  = strings.TrimSpace(line[1:])
-			idx.SeqId   += 1
-			idx.SeqSize  = 0
+			idx.SeqSize   = 0
+			idx.LineBases = 0
+			idx.LineWidth = 0
+			lineEnd       = false
+			regular       = true
 
 		} else {
-			if len(line) != 0 {
+			blank := fastaio.IsBlank(line)
+
+			if ! blank && idx.SeqId == 0 {
+				return fmt.Errorf("%w: %s:%d: offset %d: %s", ErrInvalidFa, filename, lineNum, position - int64(size), IssueDataBeforeHeader)
+			}
+
+			if ! blank {
+				if idx.LineBases == 0 {
+					idx.LineBases = int64(len(line))
+					idx.LineWidth = int64(size)
+					if size == len(line) { // last line, without line ending
+						idx.LineWidth += 1
+					}
+				} else
+				if lineEnd || int64(len(line)) > idx.LineBases {
+					regular = false
+				} else
+				if size != len(line) && int64(size) != idx.LineWidth - idx.LineBases + int64(len(line)) {
+					regular = false // mixed line endings
+				}
+
+				if int64(len(line)) < idx.LineBases {
+					lineEnd = true
+				}
+
 				idx.SeqSize += int64(len(line))
+			} else
+			if idx.SeqSize == 0 {
+				idx.SeqOffset = position // blank lines between the header and the first base
+			} else {
+				lineEnd = true
 			}
 		}
   	}
 
-	idx.Print()
-	if idx.SeqName != "" {
-		idx.Print()
-		idx.Write(fo)
+	if idx.SeqName == "" {
+		return fmt.Errorf("%w: %s: no sequence found", ErrInvalidFa, filename)
+	}
+
+	if err := write(); err != nil {
+		return err
 	}
 
-	fo.Close()
-	os.Rename(idxNameTmp, idxName)
+	if err := fastaio.CommitTemp(fo, idxName); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+
+	return nil
 }
 
 
@@ -151,11 +540,21 @@ func CreateFastaIndex(filename string) {
 /*
 ReadFastaIndexCreatingIfNotExists: read fasta index, creating it first if it does not exists
 inputs                           : filename string
-outputs                          : *[]*IdxData
+outputs                          : *Index
+                                   error
 */
-func ReadFastaIndexCreatingIfNotExists(filename string) *[]*IdxData {
-	CreateFastaIndexIfNotExists(filename)
-	return ReadFastaIndex(filename)
+func ReadFastaIndexCreatingIfNotExists(filename string) (*Index, error) {
+	if err := CreateFastaIndexIfNotExists(filename); err != nil {
+		return nil, err
+	}
+
+	// already checked against the fasta file
+	format, found := FindFastaIndex(filename)
+	if ! found {
+		return nil, fmt.Errorf("%w: index file %s does not exists", ErrInvalidIdx, IndexName(filename, FormatIdx))
+	}
+
+	return readFastaIndex(filename, format)
 }
 
 
@@ -163,46 +562,234 @@ func ReadFastaIndexCreatingIfNotExists(filename string) *[]*IdxData {
 /*
 ReadFastaIndex: reads a fasta index
 input         : filename string
-returns       : *[]*IdxData
+returns       : *Index
+                error
 */
-func ReadFastaIndex(filename string) *[]*IdxData {
-	idxName    := filename+".idx"
+func ReadFastaIndex(filename string) (*Index, error) {
+	format, found := FindFastaIndex(filename)
 
-	if _, err := os.Stat(idxName); os.IsNotExist(err) {
-		log.Fatal("Index file", idxName, "does not exists")
-		os.Exit(1)
+	if ! found {
+		return nil, fmt.Errorf("%w: index file %s does not exists", ErrInvalidIdx, IndexName(filename, FormatIdx))
 	}
 
-        fi, err := os.Open(idxName)
-	check(err)
-	defer fi.Close()
+	stored, cur, err := checkSource(filename, format)
+	if err != nil {
+		return nil, err
+	}
 
-        d, err := fi.Stat()
-	check(err)
+	if cur != nil {
+		updateSourceInfo(filename, stored, cur, false)
+	}
 
-	log.Println(d)
+	return readFastaIndex(filename, format)
+}
+
+/*
+readFastaIndex: ReadFastaIndex, without checking the index against the
+                fasta file
+*/
+func readFastaIndex(filename string, format string) (*Index, error) {
+	idxName    := IndexName(filename, format)
+
+        fi, err := os.Open(idxName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+	defer fi.Close()
 
 	data     := []*IdxData{}
+	lineNum  := 0
 
-	scanner  := bufio.NewScanner(fi)
-	scanner.Split(bufio.ScanLines)
+	lr       := fastaio.NewLineReader(fi)
 
-	for scanner.Scan() {
-		line     := scanner.Text()
+	for {
+		lineB, _, err := lr.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s:%d: %w", ErrInvalidIdx, idxName, lineNum + 1, err)
+		}
+
+		line     := string(lineB)
+		lineNum   = lr.LineNum
 
 		//log.Println(line)
 
+		// source header. only the first line of native indexes, as sequence
+		// names may start with '#'
+		if lineNum == 1 && format == FormatIdx && strings.HasPrefix(line, sourceTag + "\t") {
+			continue
+		}
+
 		idx      := new(IdxData)
 
-		idx.Read(line)
+		if format == FormatFai {
+			err = idx.ReadFai(line)
+			idx.SeqId = len(data) + 1
+		} else {
+			err = idx.Read(line)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", idxName, lineNum, err)
+		}
 
 		data      = append(data, idx)
 	}
 
 	if len(data) == 0 {
-		log.Panic("NO DATA IN INDEX")
+		return nil, fmt.Errorf("%w: %s: no data in index", ErrInvalidIdx, idxName)
+	}
+
+	if format == FormatFai {
+		if err := findHeaderPositions(filename, data); err != nil {
+			return nil, err
+		}
+	}
+
+	ix, err := NewIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", idxName, err)
+	}
+
+	if dups := ix.Duplicates(); len(dups) != 0 {
+		log.Println("Index", idxName, "has duplicate sequence names:", strings.Join(dups, ", "))
+	}
+
+	return ix, nil
+}
+
+
+
+/*
+findHeaderPositions: faidx only stores the position of the first base.
+                     find the header line of each record, which is the
+                     last line starting with '>' between the end of the
+                     previous record and the first base
+inputs             : filename string
+                     data     []*IdxData
+outputs            : err      error
+*/
+func findHeaderPositions(filename string, data []*IdxData) (err error) {
+	fi, err := fastaio.Open(filename)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidFa, err)
+	}
+	defer fi.Close()
+
+	if fi.IsSequential() {
+		return findHeaderPositionsSequential(fi, data)
+	}
+
+	start   := int64(0)
+
+	for _, idx := range data {
+		if idx.SeqOffset < start {
+			return fmt.Errorf("%w: offset of '%s' overlaps previous sequence", ErrInvalidIdx, idx.SeqName)
+		}
+
+		buf    := make([]byte, idx.SeqOffset - start)
+		if err := fi.SeekTo(start); err != nil {
+			return fmt.Errorf("%w: %s: reading header of '%s': %w", ErrInvalidIdx, filename, idx.SeqName, err)
+		}
+		if _, err := io.ReadFull(fi, buf); err != nil {
+			return fmt.Errorf("%w: %s: reading header of '%s': %w", ErrInvalidIdx, filename, idx.SeqName, err)
+		}
+
+		pos    := -1
+		for i := len(buf) - 1; i >= 0; i-- {
+			if buf[i] == '>' && ( i == 0 || buf[i-1] == '\n' ) {
+				pos = i
+				break
+			}
+		}
+
+		if pos == -1 {
+			return fmt.Errorf("%w: %s: no header found for '%s'", ErrInvalidIdx, filename, idx.SeqName)
+		}
+
+		// faidx only keeps the id. the description is in the header line
+		header     := buf[pos+1:]
+		if nl := bytes.IndexByte(header, '\n'); nl != -1 {
+			header = header[:nl]
+		}
+		_, idx.SeqDesc = SplitHeader(string(header))
+
+		idx.SeqPos = start + int64(pos)
+		start      = idx.SeqOffset + idx.seqBytes()
+	}
+
+	return nil
+}
+
+/*
+findHeaderPositionsSequential: as findHeaderPositions, in a single pass
+                               over the file, for files that can not seek
+                               without decompressing from the start
+inputs                       : fi   *fastaio.File
+                               data []*IdxData
+outputs                      : err  error
+*/
+func findHeaderPositionsSequential(fi *fastaio.File, data []*IdxData) (err error) {
+	lr         := fastaio.NewLineReader(fi)
+
+	position   := int64(0)
+	start      := int64(0)  // end of the previous record
+	headerPos  := int64(-1) // last header line after start
+	header     := ""
+	next       := 0         // record whose first base has not been reached
+
+	// the records whose first base is at or before a position
+	reach      := func(pos int64) (err error) {
+		for ; next < len(data) && data[next].SeqOffset <= pos; next++ {
+			idx := data[next]
+
+			if idx.SeqOffset < start {
+				return fmt.Errorf("%w: offset of '%s' overlaps previous sequence", ErrInvalidIdx, idx.SeqName)
+			}
+			if headerPos == -1 {
+				return fmt.Errorf("%w: %s: no header found for '%s'", ErrInvalidIdx, fi.Filename, idx.SeqName)
+			}
+
+			_, idx.SeqDesc = SplitHeader(header)
+
+			idx.SeqPos = headerPos
+			start      = idx.SeqOffset + idx.seqBytes()
+			headerPos  = -1
+		}
+		return nil
+	}
+
+	for next < len(data) {
+		line, size, err := lr.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s:%d: %w", ErrInvalidFa, fi.Filename, lr.LineNum + 1, err)
+		}
+
+		if err = reach(position); err != nil {
+			return err
+		}
+
+		if position >= start && len(line) != 0 && line[0] == '>' {
+			headerPos = position
+			header    = string(line[1:])
+		}
+
+		position += int64(size)
+	}
+
+	if err = reach(position); err != nil {
+		return err
+	}
+
+	if next < len(data) {
+		return fmt.Errorf("%w: %s: offset of '%s' past the end of the file", ErrInvalidIdx, fi.Filename, data[next].SeqName)
 	}
 
-	return &data
+	return nil
 }
 
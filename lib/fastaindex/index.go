@@ -0,0 +1,118 @@
+package fastaindex
+
+// loaded index with lookups by name and id
+
+import (
+	"fmt"
+)
+
+
+/*
+Index: the records of a fasta index, in file order, with lookups by name
+       and by id
+*/
+type Index struct {
+	records    []*IdxData
+	byName     map[string]*IdxData
+	byId       map[int]*IdxData
+	duplicates []string
+	totalSize  int64
+}
+
+/*
+NewIndex: builds the lookups of a list of records. records with an id
+          already seen are kept, but only the first one is found by name
+inputs  : records []*IdxData - in file order
+outputs : ix      *Index
+          err     error - for duplicate ids
+*/
+func NewIndex(records []*IdxData) (ix *Index, err error) {
+	ix = &Index{
+		records: records,
+		byName : make(map[string]*IdxData, len(records)),
+		byId   : make(map[int]*IdxData   , len(records)),
+	}
+
+	for _, idx := range records {
+		if _, ok := ix.byId[idx.SeqId]; ok {
+			return nil, fmt.Errorf("%w: duplicate sequence id %d", ErrInvalidIdx, idx.SeqId)
+		}
+		ix.byId[idx.SeqId] = idx
+
+		if _, ok := ix.byName[idx.SeqName]; ok {
+			ix.duplicates = append(ix.duplicates, idx.SeqName)
+		} else {
+			ix.byName[idx.SeqName] = idx
+		}
+
+		ix.totalSize += idx.SeqSize
+	}
+
+	return ix, nil
+}
+
+/*
+Len    : number of sequences
+outputs: int
+*/
+func (ix *Index) Len() int {
+	return len(ix.records)
+}
+
+/*
+Records: the records in file order. must not be modified
+outputs: []*IdxData
+*/
+func (ix *Index) Records() []*IdxData {
+	return ix.records
+}
+
+/*
+Each   : calls clbk for each record in file order, stopping at the first error
+inputs : clbk func(*IdxData) error
+outputs: err  error
+*/
+func (ix *Index) Each(clbk func(*IdxData) error) (err error) {
+	for _, idx := range ix.records {
+		if err = clbk(idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ByName : finds a record by its id. whole headers are also accepted, and
+         matched by their first word
+inputs : name string
+outputs: *IdxData - nil if not found
+*/
+func (ix *Index) ByName(name string) *IdxData {
+	id, _ := SplitHeader(name)
+	return ix.byName[id]
+}
+
+/*
+ByID   : finds a record by its id. ids start at 1, in file order
+inputs : id int
+outputs: *IdxData - nil if not found
+*/
+func (ix *Index) ByID(id int) *IdxData {
+	return ix.byId[id]
+}
+
+/*
+TotalSize: sum of the sizes of all sequences
+outputs  : int64
+*/
+func (ix *Index) TotalSize() int64 {
+	return ix.totalSize
+}
+
+/*
+Duplicates: names found more than once. ByName returns their first record
+outputs   : []string
+*/
+func (ix *Index) Duplicates() []string {
+	return ix.duplicates
+}
@@ -0,0 +1,370 @@
+package fastaindex
+
+// detection of indexes older than their fasta file
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+)
+
+
+// Returned, wrapped, when the fasta file changed after being indexed
+var ErrStaleIdx = fmt.Errorf("%w: fasta file changed after indexing", ErrInvalidIdx)
+
+// First characters of the header line of the native index
+const sourceTag = "#source"
+
+
+/*
+SourceInfo: size, modification time and, optionally, the md5 of the
+            fasta file when it was indexed. stored in the first line of
+            the native index as:
+            #source size=<bytes> mtime=<unix nanoseconds> [md5=<hex>]
+*/
+type SourceInfo struct {
+	Size    int64
+	ModTime int64  // unix nanoseconds
+	Md5     string // empty if not calculated
+}
+
+/*
+StatSource: reads the size and modification time of a fasta file
+inputs    : filename string
+            hash     bool - also calculate the md5 of the file
+outputs   : si       *SourceInfo
+            err      error
+*/
+func StatSource(filename string, hash bool) (si *SourceInfo, err error) {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFa, err)
+	}
+
+	si = &SourceInfo{ Size: st.Size(), ModTime: st.ModTime().UnixNano() }
+
+	if hash {
+		if si.Md5, err = hashSource(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	return si, nil
+}
+
+/*
+hashSource: md5 of the bytes of a file, as stored on disk
+inputs    : filename string
+outputs   : string
+            error
+*/
+func hashSource(filename string) (string, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidFa, err)
+	}
+	defer fi.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrInvalidFa, filename, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*
+Write  : writes the header line of the native index
+inputs : file *os.File
+outputs: err  error
+*/
+func (si *SourceInfo) Write(file *os.File) (err error) {
+	line := fmt.Sprintf("%s\tsize=%d\tmtime=%d", sourceTag, si.Size, si.ModTime)
+	if si.Md5 != "" {
+		line += "\tmd5=" + si.Md5
+	}
+	_, err = fmt.Fprintln(file, line)
+	return err
+}
+
+/*
+Read   : parses the header line of the native index
+inputs : line string
+outputs: err  error
+*/
+func (si *SourceInfo) Read(line string) (err error) {
+	cols := strings.Split(line, "\t")
+
+	if cols[0] != sourceTag {
+		return fmt.Errorf("%w: expected '%s' header", ErrInvalidIdx, sourceTag)
+	}
+
+	for _, col := range cols[1:] {
+		kv := strings.SplitN(col, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%w: invalid header field '%s'", ErrInvalidIdx, col)
+		}
+
+		switch kv[0] {
+		case "size":
+			si.Size, err = strconv.ParseInt(kv[1], 10, 64)
+		case "mtime":
+			si.ModTime, err = strconv.ParseInt(kv[1], 10, 64)
+		case "md5":
+			si.Md5 = kv[1]
+		}
+		// unknown fields are ignored
+
+		if err != nil {
+			return fmt.Errorf("%w: header field '%s': %w", ErrInvalidIdx, col, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Matches: checks whether a fasta file is the one that was indexed. a file
+         with the same size but a new modification time still matches if
+         its md5 was stored and is unchanged
+inputs : filename string
+outputs: bool
+         error
+*/
+func (si *SourceInfo) Matches(filename string) (bool, error) {
+	ok, _, err := si.matches(filename)
+	return ok, err
+}
+
+/*
+matches: Matches, also returning the source information to store when the
+         file only matched by its md5. the file is stated before being
+         hashed, so later changes make it differ again
+inputs : filename string
+outputs: ok       bool
+         cur      *SourceInfo - nil unless matched by the md5
+         err      error
+*/
+func (si *SourceInfo) matches(filename string) (ok bool, cur *SourceInfo, err error) {
+	cur, err = StatSource(filename, false)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if cur.Size != si.Size {
+		return false, nil, nil
+	}
+
+	if cur.ModTime == si.ModTime {
+		return true, nil, nil
+	}
+
+	if si.Md5 == "" {
+		return false, nil, nil
+	}
+
+	sum, err := hashSource(filename)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if sum != si.Md5 {
+		return false, nil, nil
+	}
+
+	cur.Md5 = sum
+
+	return true, cur, nil
+}
+
+
+/*
+ReadSourceInfo: reads the source header of an index
+inputs        : filename string - fasta file
+                format   string
+outputs       : si       *SourceInfo - nil if the index has no header
+                err      error
+*/
+func ReadSourceInfo(filename string, format string) (si *SourceInfo, err error) {
+	if format == FormatFai {
+		return nil, nil // faidx has no header
+	}
+
+	idxName := IndexName(filename, format)
+
+	fi, err := os.Open(idxName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+	defer fi.Close()
+
+	line, _, err := fastaio.NewLineReader(fi).ReadLine()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: %s: no data in index", ErrInvalidIdx, idxName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidIdx, idxName, err)
+	}
+
+	if ! strings.HasPrefix(string(line), sourceTag) {
+		return nil, nil // written before the header existed
+	}
+
+	si = new(SourceInfo)
+	if err := si.Read(string(line)); err != nil {
+		return nil, fmt.Errorf("%s:1: %w", idxName, err)
+	}
+
+	return si, nil
+}
+
+
+/*
+CheckFastaIndex: checks that an index matches its fasta file. indexes
+                 without header (faidx and old native indexes) only have to
+                 be newer than the fasta file
+inputs         : filename string
+                 format   string
+outputs        : err      error - wraps ErrStaleIdx if the fasta file changed
+*/
+func CheckFastaIndex(filename string, format string) (err error) {
+	_, _, err = checkSource(filename, format)
+	return err
+}
+
+/*
+checkSource: CheckFastaIndex, also returning the source information stored
+             in the index and, when the fasta file only matched by its md5,
+             the one to store instead. see updateSourceInfo
+inputs     : filename string
+             format   string
+outputs    : stored   *SourceInfo - nil if the index has no header
+             cur      *SourceInfo - nil unless matched by the md5
+             err      error - wraps ErrStaleIdx if the fasta file changed
+*/
+func checkSource(filename string, format string) (stored *SourceInfo, cur *SourceInfo, err error) {
+	stored, err = ReadSourceInfo(filename, format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if stored != nil {
+		ok, cur, err := stored.matches(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ! ok {
+			return stored, nil, fmt.Errorf("%w: %s", ErrStaleIdx, filename)
+		}
+		return stored, cur, nil
+	}
+
+	st, err := os.Stat(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidFa, err)
+	}
+
+	ist, err := os.Stat(IndexName(filename, format))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+
+	if st.ModTime().After(ist.ModTime()) {
+		return nil, nil, fmt.Errorf("%w: %s is newer than its index", ErrStaleIdx, filename)
+	}
+
+	return nil, nil, nil
+}
+
+/*
+updateSourceInfo: stores the new modification time of a fasta file that
+                  only matched its index by the md5, so that it is not
+                  hashed again. failures are only logged, as the index is
+                  still valid
+inputs          : filename string
+                  stored   *SourceInfo - as read from the index
+                  cur      *SourceInfo - to store
+                  locked   bool        - the index lock is already held
+*/
+func updateSourceInfo(filename string, stored *SourceInfo, cur *SourceInfo, locked bool) {
+	log.Println("Fasta file", filename, "only changed its modification time. updating the index header")
+
+	if ! locked {
+		lock, err := lockIndex(filename)
+		if err != nil {
+			log.Println("Could not update the index header:", err)
+			return
+		}
+		defer lock.Unlock()
+	}
+
+	if err := rewriteSourceInfo(filename, stored, cur); err != nil {
+		log.Println("Could not update the index header:", err)
+	}
+}
+
+/*
+rewriteSourceInfo: replaces the header of a native index. nothing is done
+                   if the header or the fasta file changed since they were
+                   checked. the index lock must be held
+inputs           : filename string
+                   stored   *SourceInfo - expected header
+                   cur      *SourceInfo - new header
+outputs          : err      error
+*/
+func rewriteSourceInfo(filename string, stored *SourceInfo, cur *SourceInfo) (err error) {
+	now, err := ReadSourceInfo(filename, FormatIdx)
+	if err != nil {
+		return err
+	}
+	if now == nil || *now != *stored {
+		return nil // rewritten by another process
+	}
+
+	st, err := StatSource(filename, false)
+	if err != nil {
+		return err
+	}
+	if st.Size != cur.Size || st.ModTime != cur.ModTime {
+		return nil // changed again. it will be hashed on the next check
+	}
+
+	idxName := IndexName(filename, FormatIdx)
+
+	fi, err := os.Open(idxName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+	defer fi.Close()
+
+	br      := bufio.NewReader(fi)
+	if _, err = br.ReadString('\n'); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidIdx, idxName, err)
+	}
+
+	fo, err := fastaio.CreateTemp(idxName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidIdx, err)
+	}
+	defer fastaio.DiscardTemp(fo)
+
+	if err = cur.Write(fo); err == nil {
+		_, err = io.Copy(fo, br)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidIdx, idxName, err)
+	}
+
+	return fastaio.CommitTemp(fo, idxName)
+}
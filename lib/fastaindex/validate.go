@@ -0,0 +1,140 @@
+package fastaindex
+
+// fasta validation
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+)
+
+
+// Classes of problems found by Validate
+const (
+	IssueBlankLine        = "blank_line"         // empty or white space only line. ignored by the indexer and readers
+	IssueDataBeforeHeader = "data_before_header" // sequence before the first '>' header
+	IssueEmptyHeader      = "empty_header"       // '>' header without a name
+	IssueEmptyRecord      = "empty_record"       // header without sequence
+)
+
+
+/*
+Issue: a problem found in a fasta file
+*/
+type Issue struct {
+	Class   string
+	Line    int    // 1 based line number
+	Offset  int64  // position of the start of the line in the uncompressed file
+	SeqName string // id of the record where the problem was found. empty before the first header
+}
+
+/*
+Fatal  : whether the problem prevents the file from being indexed.
+         blank lines and empty records are only reported
+outputs: bool
+*/
+func (is *Issue) Fatal() bool {
+	return is.Class == IssueDataBeforeHeader || is.Class == IssueEmptyHeader
+}
+
+func (is *Issue) String() string {
+	level := "warning"
+	if is.Fatal() {
+		level = "error"
+	}
+	return fmt.Sprintf("%s\t%d\t%d\t%s\t%s", level, is.Line, is.Offset, is.Class, is.SeqName)
+}
+
+
+/*
+Validate: reads a whole fasta file reporting blank lines, sequence data
+          before the first header, empty headers and records without
+          sequence. the file is not changed
+inputs  : filename string
+outputs : issues   []*Issue
+          err      error - only for errors reading the file
+*/
+func Validate(filename string) (issues []*Issue, err error) {
+	fi, err := fastaio.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFa, err)
+	}
+	defer fi.Close()
+
+	lr        := fastaio.NewLineReader(fi)
+
+	position  := int64(0)
+	seqName   := ""
+	inRecord  := false // a header was found
+	hasSeq    := false // the current record has sequence
+	orphan    := false // data before header was reported
+	headLine  := 0
+	headPos   := int64(0)
+
+	add       := func(class string, line int, offset int64) {
+		issues = append(issues, &Issue{ Class: class, Line: line, Offset: offset, SeqName: seqName })
+	}
+
+	endRecord := func() {
+		if inRecord && ! hasSeq {
+			add(IssueEmptyRecord, headLine, headPos)
+		}
+	}
+
+	for {
+		line, size, err := lr.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return issues, fmt.Errorf("%w: %s:%d: %w", ErrInvalidFa, filename, lr.LineNum + 1, err)
+		}
+
+		lineNum   := lr.LineNum
+		lineStart := position
+		position  += int64(size)
+
+		if fastaio.IsBlank(line) {
+			add(IssueBlankLine, lineNum, lineStart)
+			continue
+		}
+
+		if line[0] == '>' {
+			endRecord()
+
+			seqName, _ = SplitHeader(string(line[1:]))
+			inRecord = true
+			hasSeq   = false
+			headLine = lineNum
+			headPos  = lineStart
+
+			if seqName == "" {
+				add(IssueEmptyHeader, lineNum, lineStart)
+			}
+			continue
+		}
+
+		if ! inRecord {
+			// reported once, at the first line of data
+			if ! orphan {
+				add(IssueDataBeforeHeader, lineNum, lineStart)
+				orphan = true
+			}
+			continue
+		}
+
+		hasSeq = true
+	}
+
+	endRecord()
+
+	// empty records are found after the lines that follow their header
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Line < issues[j].Line })
+
+	return issues, nil
+}
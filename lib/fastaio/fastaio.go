@@ -0,0 +1,576 @@
+/*
+Package fastaio opens plain, gzip and bgzf compressed files, allowing
+seeks to positions of the uncompressed data
+*/
+
+package fastaio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// Error codes returned by failures to parse
+var (
+	ErrInternal   = errors.New("fastaio: internal error"   )
+	ErrInvalidGz  = errors.New("fastaio: invalid gzip file")
+	ErrInvalidGzi = errors.New("fastaio: invalid gzi file" )
+)
+
+
+// Kinds of files
+const (
+	KindPlain = iota
+	KindGzip
+	KindBgzf
+)
+
+// Extension of the bgzf block index. same format as htslib
+const GziExt = ".gzi"
+
+
+/*
+GetKind: detects whether a file is plain text, gzip or bgzf compressed
+         by reading its first bytes
+inputs : filename string
+outputs: kind     int
+         err      error
+*/
+func GetKind(filename string) (kind int, err error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return KindPlain, err
+	}
+	defer fi.Close()
+
+	// gzip header (10 bytes), XLEN (2 bytes) and the BC subfield header (4 bytes)
+	header := make([]byte, 16)
+	n, err := io.ReadFull(fi, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return KindPlain, err
+	}
+
+	return kindFromHeader(header[:n]), nil
+}
+
+func kindFromHeader(header []byte) int {
+	if len(header) < 2 || header[0] != 0x1f || header[1] != 0x8b {
+		return KindPlain
+	}
+
+	// FEXTRA flag set and first subfield is 'BC' with 2 bytes of data
+	if len(header) >= 16 && header[3] & 4 != 0 && header[12] == 'B' && header[13] == 'C' && header[14] == 2 && header[15] == 0 {
+		return KindBgzf
+	}
+
+	return KindGzip
+}
+
+
+
+/*
+GziEntry: start of a bgzf block, both in the compressed file and in the uncompressed data
+*/
+type GziEntry struct {
+	Compressed   uint64
+	Uncompressed uint64
+}
+
+/*
+Gzi: index of bgzf blocks, ordered by position. the first block (0, 0) is implicit
+*/
+type Gzi []GziEntry
+
+/*
+Find  : returns the block containing an uncompressed position
+input : position int64
+output: entry    GziEntry
+*/
+func (gzi Gzi) Find(position int64) (entry GziEntry) {
+	i := sort.Search(len(gzi), func(i int) bool { return gzi[i].Uncompressed > uint64(position) })
+	if i == 0 {
+		return GziEntry{}
+	}
+	return gzi[i-1]
+}
+
+
+
+/*
+ScanBgzf: reads the headers of all blocks of a bgzf file without decompressing them
+inputs  : filename string
+outputs : gzi      Gzi
+          err      error
+*/
+func ScanBgzf(filename string) (gzi Gzi, err error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	gzi          = Gzi{}
+	compressed  := uint64(0)
+	uncompressed:= uint64(0)
+	header      := make([]byte, 18)
+	footer      := make([]byte, 4)
+
+	for {
+		if _, err = io.ReadFull(fi, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %s: block at %d: %w", ErrInvalidGz, filename, compressed, err)
+		}
+
+		if kindFromHeader(header[:16]) != KindBgzf {
+			return nil, fmt.Errorf("%w: %s: block at %d is not bgzf", ErrInvalidGz, filename, compressed)
+		}
+
+		// BSIZE: total block size minus 1
+		blockSize := uint64(binary.LittleEndian.Uint16(header[16:18])) + 1
+
+		// ISIZE: uncompressed size, in the last 4 bytes of the block
+		if _, err = fi.ReadAt(footer, int64(compressed + blockSize - 4)); err != nil {
+			return nil, fmt.Errorf("%w: %s: block at %d: %w", ErrInvalidGz, filename, compressed, err)
+		}
+
+		if compressed != 0 {
+			gzi = append(gzi, GziEntry{ Compressed: compressed, Uncompressed: uncompressed })
+		}
+
+		compressed   += blockSize
+		uncompressed += uint64(binary.LittleEndian.Uint32(footer))
+
+		if _, err = fi.Seek(int64(compressed), 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return gzi, nil
+}
+
+
+
+/*
+CreateGzi: creates the block index of a bgzf file
+inputs   : filename string
+outputs  : err      error
+creates  : filename.gzi
+*/
+func CreateGzi(filename string) (err error) {
+	gzi, err := ScanBgzf(filename)
+	if err != nil {
+		return err
+	}
+
+	gziName    := filename + GziExt
+
+	fo, err    := CreateTemp(gziName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidGzi, err)
+	}
+	defer DiscardTemp(fo)
+
+	w   := bufio.NewWriter(fo)
+	buf := make([]byte, 8)
+
+	binary.LittleEndian.PutUint64(buf, uint64(len(gzi)))
+	w.Write(buf)
+
+	for _, entry := range gzi {
+		binary.LittleEndian.PutUint64(buf, entry.Compressed)
+		w.Write(buf)
+		binary.LittleEndian.PutUint64(buf, entry.Uncompressed)
+		w.Write(buf)
+	}
+
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidGzi, gziName, err)
+	}
+
+	if err = CommitTemp(fo, gziName); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidGzi, err)
+	}
+
+	return nil
+}
+
+
+
+/*
+ReadGzi: reads the block index of a bgzf file
+inputs : filename string
+outputs: gzi      Gzi
+         err      error
+*/
+func ReadGzi(filename string) (gzi Gzi, err error) {
+	gziName := filename + GziExt
+
+	fi, err := os.Open(gziName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidGzi, err)
+	}
+	defer fi.Close()
+
+	r       := bufio.NewReader(fi)
+	buf     := make([]byte, 16)
+
+	if _, err = io.ReadFull(r, buf[:8]); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidGzi, gziName, err)
+	}
+
+	count   := binary.LittleEndian.Uint64(buf[:8])
+	gzi      = make(Gzi, 0, count)
+
+	for i := uint64(0); i < count; i++ {
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("%w: %s: entry %d: %w", ErrInvalidGzi, gziName, i, err)
+		}
+
+		gzi = append(gzi, GziEntry{ Compressed: binary.LittleEndian.Uint64(buf[:8]), Uncompressed: binary.LittleEndian.Uint64(buf[8:]) })
+	}
+
+	return gzi, nil
+}
+
+
+
+/*
+LoadGzi: reads the block index of a bgzf file, scanning the blocks if
+         the index file does not exist
+inputs : filename string
+outputs: gzi      Gzi
+         err      error
+*/
+func LoadGzi(filename string) (gzi Gzi, err error) {
+	if _, err := os.Stat(filename + GziExt); err == nil {
+		return ReadGzi(filename)
+	}
+
+	log.Println("Gzi index", filename + GziExt, "does not exists. scanning blocks")
+
+	return ScanBgzf(filename)
+}
+
+
+
+/*
+File: a plain, gzip or bgzf file read as uncompressed data
+*/
+type File struct {
+	Filename string
+	Kind     int
+	file     *os.File
+	gz       *gzip.Reader
+	gzi      Gzi
+	r        io.Reader
+}
+
+/*
+Open   : opens a file, detecting its compression
+inputs : filename string
+outputs: f        *File
+         err      error
+*/
+func Open(filename string) (f *File, err error) {
+	kind, err := GetKind(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f = &File{ Filename: filename, Kind: kind, file: file, r: file }
+
+	if kind != KindPlain {
+		if f.gz, err = gzip.NewReader(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidGz, filename, err)
+		}
+		f.r = f.gz
+	}
+
+	return f, nil
+}
+
+/*
+OpenAndSeek: opens a file and seeks to a position of the uncompressed data
+inputs     : filename string
+             position int64
+outputs    : f        *File
+             err      error
+*/
+func OpenAndSeek(filename string, position int64) (f *File, err error) {
+	f, err = Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = f.SeekTo(position); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+/*
+SeekTo: moves to a position of the uncompressed data, counted from the start.
+        bgzf files jump to the containing block using the gzi index. plain
+        gzip files have to be decompressed from the start
+input : position int64
+output: err      error
+*/
+func (f *File) SeekTo(position int64) (err error) {
+	if f.Kind == KindPlain {
+		_, err = f.file.Seek(position, 0)
+		return err
+	}
+
+	start := GziEntry{}
+
+	if f.Kind == KindBgzf && position > 0 {
+		if f.gzi == nil {
+			if f.gzi, err = LoadGzi(f.Filename); err != nil {
+				return err
+			}
+		}
+		start = f.gzi.Find(position)
+	}
+
+	if _, err = f.file.Seek(int64(start.Compressed), 0); err != nil {
+		return err
+	}
+
+	if err = f.gz.Reset(f.file); err != nil {
+		return fmt.Errorf("%w: %s: block at %d: %w", ErrInvalidGz, f.Filename, start.Compressed, err)
+	}
+
+	if _, err = io.CopyN(io.Discard, f.gz, position - int64(start.Uncompressed)); err != nil {
+		return fmt.Errorf("%w: %s: seeking to %d: %w", ErrInvalidGz, f.Filename, position, err)
+	}
+
+	return nil
+}
+
+/*
+IsSequential: whether the file is a plain gzip file, where every seek
+              decompresses from the first byte. see IsSequential
+outputs     : bool
+*/
+func (f *File) IsSequential() bool {
+	return f.Kind == KindGzip
+}
+
+func (f *File) Read(p []byte) (n int, err error) {
+	return f.r.Read(p)
+}
+
+func (f *File) Close() (err error) {
+	if f.gz != nil {
+		f.gz.Close()
+	}
+	return f.file.Close()
+}
+
+
+
+/*
+Stream: a plain or gzip compressed stream, which can not seek
+*/
+type Stream struct {
+	r      io.Reader
+	closer io.Closer
+	gz     *gzip.Reader
+}
+
+/*
+IsStream: checks whether a filename refers to a stream which can not be
+          indexed or seeked: "-" for stdin, pipes and other non regular files
+inputs  : filename string
+outputs : bool
+*/
+func IsStream(filename string) bool {
+	if filename == "-" {
+		return true
+	}
+
+	st, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+
+	return ! st.Mode().IsRegular()
+}
+
+/*
+IsSequential: checks whether a file can only be read efficiently from the
+              start: streams, and gzip files that are not bgzf compressed,
+              where every seek decompresses from the first byte. reading
+              their records one by one by position is quadratic
+inputs      : filename string
+outputs     : bool
+              error
+*/
+func IsSequential(filename string) (bool, error) {
+	if IsStream(filename) {
+		return true, nil
+	}
+
+	kind, err := GetKind(filename)
+	if err != nil {
+		return false, err
+	}
+
+	return kind == KindGzip, nil
+}
+
+/*
+OpenStream: opens a file for sequential reading. "-" reads from stdin.
+            gzip and bgzf compression is detected from the first bytes
+inputs    : filename string
+outputs   : s        *Stream
+            err      error
+*/
+func OpenStream(filename string) (s *Stream, err error) {
+	var r io.ReadCloser = os.Stdin
+
+	if filename != "-" {
+		if r, err = os.Open(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	if s, err = NewStream(r); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	s.closer = r
+
+	return s, nil
+}
+
+/*
+NewStream: wraps a reader, decompressing it if it starts with the gzip magic
+inputs   : r   io.Reader
+outputs  : s   *Stream
+           err error
+*/
+func NewStream(r io.Reader) (s *Stream, err error) {
+	br    := bufio.NewReader(r)
+	s      = &Stream{ r: br }
+
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if kindFromHeader(magic) != KindPlain {
+		if s.gz, err = gzip.NewReader(br); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidGz, err)
+		}
+		s.r = s.gz
+	}
+
+	return s, nil
+}
+
+func (s *Stream) Read(p []byte) (n int, err error) {
+	return s.r.Read(p)
+}
+
+func (s *Stream) Close() (err error) {
+	if s.gz != nil {
+		s.gz.Close()
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+
+
+/*
+LineReader: reads lines of any length, unlike bufio.Scanner which stops
+            at 64 KB. "\n" and "\r\n" line endings are removed, but
+            counted in the size of the line, so file positions can be
+            tracked
+*/
+type LineReader struct {
+	br      *bufio.Reader
+	buf     []byte
+	LineNum int
+}
+
+/*
+NewLineReader: creates a LineReader
+inputs       : r io.Reader
+outputs      : *LineReader
+*/
+func NewLineReader(r io.Reader) *LineReader {
+	return &LineReader{ br: bufio.NewReaderSize(r, 1 << 16) }
+}
+
+/*
+ReadLine: reads the next line. the line is only valid until the next call
+outputs : line []byte - without line ending
+          size int    - bytes read, including the line ending
+          err  error  - io.EOF if there are no more lines
+*/
+func (lr *LineReader) ReadLine() (line []byte, size int, err error) {
+	line, err = lr.br.ReadSlice('\n')
+
+	if err == bufio.ErrBufferFull {
+		lr.buf = append(lr.buf[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = lr.br.ReadSlice('\n')
+			lr.buf    = append(lr.buf, line...)
+		}
+		line = lr.buf
+	}
+
+	if err == io.EOF && len(line) != 0 {
+		err = nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lr.LineNum++
+
+	size = len(line)
+
+	if size > 0 && line[size-1] == '\n' {
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+	}
+
+	return line, size, nil
+}
+
+
+
+/*
+IsBlank: whether a line is empty or only has white space. blank lines are
+         skipped by the indexer and the readers
+inputs : line []byte
+outputs: bool
+*/
+func IsBlank(line []byte) bool {
+	return len(bytes.TrimSpace(line)) == 0
+}
@@ -0,0 +1,60 @@
+//go:build !unix
+
+package fastaio
+
+// advisory locks for systems without flock. the lock is the existence of
+// the lock file, created exclusively
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+
+// Time between attempts to create the lock file
+const lockPoll = 100 * time.Millisecond
+
+
+/*
+FileLock: an exclusive advisory lock shared between processes. the lock
+          file exists while the lock is held. a process killed while
+          holding it leaves the file behind, and it must be removed by hand
+*/
+type FileLock struct {
+	name string
+}
+
+/*
+Lock   : waits until an exclusive lock on filename is acquired
+inputs : filename string
+outputs: l        *FileLock
+         err      error
+*/
+func Lock(filename string) (l *FileLock, err error) {
+	for {
+		fi, err := os.OpenFile(filename, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+		if err == nil {
+			fi.Close()
+			return &FileLock{ name: filename }, nil
+		}
+
+		if ! errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("%w: lock %s: %w", ErrInternal, filename, err)
+		}
+
+		time.Sleep(lockPoll)
+	}
+}
+
+/*
+Unlock : releases the lock
+outputs: err error
+*/
+func (l *FileLock) Unlock() (err error) {
+	if err = os.Remove(l.name); err != nil {
+		return fmt.Errorf("%w: unlock %s: %w", ErrInternal, l.name, err)
+	}
+	return nil
+}
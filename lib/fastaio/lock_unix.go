@@ -0,0 +1,61 @@
+//go:build unix
+
+package fastaio
+
+// advisory locks using flock
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+
+/*
+FileLock: an exclusive advisory lock shared between processes. the lock
+          file is left in place after unlocking, as removing it would let
+          two processes hold locks on different files of the same name
+*/
+type FileLock struct {
+	file *os.File
+}
+
+/*
+Lock   : waits until an exclusive lock on filename is acquired. the file
+         is created if needed
+inputs : filename string
+outputs: l        *FileLock
+         err      error
+*/
+func Lock(filename string) (l *FileLock, err error) {
+	fi, err := os.OpenFile(filename, os.O_RDWR | os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%w: lock %s: %w", ErrInternal, filename, err)
+	}
+
+	for {
+		err = syscall.Flock(int(fi.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+
+	if err != nil {
+		fi.Close()
+		return nil, fmt.Errorf("%w: lock %s: %w", ErrInternal, filename, err)
+	}
+
+	return &FileLock{ file: fi }, nil
+}
+
+/*
+Unlock : releases the lock
+outputs: err error
+*/
+func (l *FileLock) Unlock() (err error) {
+	// closing the file releases the lock
+	if err = l.file.Close(); err != nil {
+		return fmt.Errorf("%w: unlock %s: %w", ErrInternal, l.file.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package fastaio
+
+// temporary output files and locks shared between processes
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+
+// Permissions of new output files, before the umask, as os.Create
+const outputPerm os.FileMode = 0666
+
+// Attempts to find an unused temporary name
+const tempTries = 10000
+
+
+/*
+CreateTemp: creates a temporary file, with a unique name, next to the file
+            it will replace, so that it can be renamed atomically. it gets
+            the permissions of the file it replaces or, for new files,
+            outputPerm restricted by the umask
+inputs    : filename string
+outputs   : fo       *os.File
+            err      error
+*/
+func CreateTemp(filename string) (fo *os.File, err error) {
+	for try := 0; try < tempTries; try++ {
+		tmpName := fmt.Sprintf("%s.%d.tmp", filename, rand.Uint32())
+
+		fo, err  = os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_EXCL, outputPerm)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+
+		st, err := os.Stat(filename)
+		if err != nil {
+			return fo, nil // new file
+		}
+
+		if err = fo.Chmod(st.Mode().Perm()); err != nil {
+			DiscardTemp(fo)
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+
+		return fo, nil
+	}
+
+	return nil, fmt.Errorf("%s: %w", filename, os.ErrExist)
+}
+
+/*
+CommitTemp: closes a temporary file created by CreateTemp and renames it to
+            its final name. on errors the temporary file is removed
+inputs    : fo       *os.File
+            filename string
+outputs   : err      error
+*/
+func CommitTemp(fo *os.File, filename string) (err error) {
+	if err = fo.Close(); err != nil {
+		os.Remove(fo.Name())
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if err = os.Rename(fo.Name(), filename); err != nil {
+		os.Remove(fo.Name())
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return nil
+}
+
+/*
+DiscardTemp: closes and removes a temporary file created by CreateTemp.
+             does nothing if it was already committed
+inputs     : fo *os.File
+*/
+func DiscardTemp(fo *os.File) {
+	fo.Close()
+	os.Remove(fo.Name())
+}
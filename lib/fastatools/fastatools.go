@@ -6,211 +6,348 @@ package fastatools
 
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
+	"strconv"
 	"strings"
 )
 
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaindex"
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+)
+
 // Error codes returned by failures to parse
 var (
 	ErrInternal   = errors.New("fastatools: internal error" )
 	ErrInvalidSeq = errors.New("fastatools: invalid fasta"  )
 )
 
-
-/*
-check: This helper will streamline our error checks below.
-src  : https://gobyexample.com/reading-files
-input: e error
-*/
-func check(e error) {
-	if e != nil {
-		log.Fatal(e)
-		panic(e)
-	}
-}
+// Offset of the phred quality scores of fastq files (Sanger / Illumina 1.8+)
+const QualityOffset = 33
 
 type SeqData struct {
-	SeqName  string
+	SeqName  string // first word of the header
+	SeqDesc  string // rest of the header
 	Sequence []byte
+	Quality  []byte // fastq only. nil for fasta
 }
 
 func (seqd *SeqData) Size() (size int64) {
 	return int64(len(seqd.Sequence))
 }
 
+/*
+Header : the header line, without '>' or '@'
+outputs: string
+*/
+func (seqd *SeqData) Header() string {
+	return fastaindex.JoinHeader(seqd.SeqName, seqd.SeqDesc)
+}
+
 func (seqd *SeqData) Print () {
 	log.Printf("SeqData: NAME '%s' SIZE %d\n", seqd.SeqName, seqd.Size())
 }
 
-func (seqd *SeqData) SaveToFasta(fo *os.File) {
-        fmt.Fprintf(fo, ">%s\n", seqd.SeqName)
-
-	leng := len(seqd.Sequence)
-
-	start := 0
-	end   := 80
-	sum   := 0
-
-	for ; start < leng; start += 80 {
-		end = start + 80
-
-		if end >= leng {
-			end = leng
+/*
+CountLowQuality: number of bases with a phred quality lower than minQual
+input          : minQual int
+output         : low     int
+*/
+func (seqd *SeqData) CountLowQuality(minQual int) (low int) {
+	for _, q := range seqd.Quality {
+		if int(q) - QualityOffset < minQual {
+			low++
 		}
+	}
+	return low
+}
 
-		if end != start {
-			frag := string(seqd.Sequence[start:end])
-        		fmt.Fprintf(fo, frag + "\n")
-			sum  += len(frag)
+/*
+MaskLowQuality: replaces bases with a phred quality lower than minQual by N
+input         : minQual int
+output        : masked  int - number of bases masked
+*/
+func (seqd *SeqData) MaskLowQuality(minQual int) (masked int) {
+	for i, q := range seqd.Quality {
+		if int(q) - QualityOffset < minQual {
+			seqd.Sequence[i] = 'N'
+			masked++
 		}
 	}
+	return masked
+}
 
-	log.Println( "LENG", leng )
-	log.Println( "SUM ", sum  )
+/*
+SaveToFasta: writes the record in fasta format, DefaultLineWidth bases per line
+input      : w   io.Writer
+output     : err error
+*/
+func (seqd *SeqData) SaveToFasta(w io.Writer) (err error) {
+	fw := NewWriter(w, DefaultLineWidth)
+	if err = fw.Write(seqd); err != nil {
+		return err
+	}
+	return fw.Flush()
 }
 
 
 
 /*
-ReadFileLineByLine: reads line by line using callback
-input             : fi   *os.File
-                    clbk func(*string)(res bool)
+readSeqFromFasta: read the next fasta Sequence of a reader
+input           : reader   *Reader
+return          : sd       *SeqData
+                  err      error
 */
-func ReadFileLineByLine(fi *os.File, clbk func(*string)(res bool)) {
-	scanner  := bufio.NewScanner(fi)
-	scanner.Split(bufio.ScanLines)
-
-	for scanner.Scan() {
-		line     := scanner.Text()
-		res      := clbk(&line)
-		if ! res {
-			break
-		}
-  	}
+func readSeqFromFasta(reader *Reader) (sd *SeqData, err error) {
+	log.Println("Seq READING")
+
+	sd, err = reader.Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: no sequence found", ErrInvalidSeq)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Seq", sd.SeqName, "DONE")
+
+	return sd, nil
+}
+
+/*
+OpenAndSeek: opens a plain, gzip or bgzf file and seeks to a position of
+             the uncompressed data
+input      : filename string
+             position int64
+return     : file     *fastaio.File
+             err      error
+*/
+func OpenAndSeek(filename string, position int64) (file *fastaio.File, err error) {
+        file, err = fastaio.OpenAndSeek(filename, position)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: seeking to %d: %w", ErrInvalidSeq, filename, position, err)
+	}
+
+	return file, nil
 }
 
 
 /*
-readSeqFromFasta: read a fasta Sequence inside a file
-input           : file     *os.File
-return          : sd       *SeqData
+ReadFastaSeq: read a fasta Sequence inside a file
+input       : filename string
+              position string
+return      : sd       *SeqData
+              err      error
 */
-func readSeqFromFasta(file *os.File) (sd *SeqData) {
-	sd       = new(SeqData)
+func ReadFastaSeq(filename string, position int64) (sd *SeqData, err error) {
+	reader, err := OpenReaderAt(filename, position)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	//log.Println("new positions", pos)
 
-	var buffer bytes.Buffer
+	sd, err = readSeqFromFasta(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: position %d: %w", filename, position, err)
+	}
 
-	processFastaLine := func( line *string ) ( res bool ){
-		if (*line)[0] == byte('>') {
-			if sd.SeqName == "" { // first
-				sd.SeqName = strings.TrimSpace((*line)[1:])
-				log.Println("Seq", sd.SeqName, "STARTING")
-				return true
+	sd.Print()
 
-			} else { //next
-				log.Println("Seq", sd.SeqName, "DONE"    )
-				return false
+	return sd, nil
+}
 
-			}
-		} else {
-			if len(*line) != 0 {
-				buffer.WriteString(*line)
-			}
 
-			return true
+
+
+/*
+Region: an interval of a sequence. 0-based, half open
+*/
+type Region struct {
+	SeqName string
+	Start   int64 // first base, inclusive
+	End     int64 // last base, exclusive. -1 for the end of the sequence
+}
+
+func (reg *Region) String() string {
+	if reg.End == -1 {
+		if reg.Start == 0 {
+			return reg.SeqName
 		}
+		return fmt.Sprintf("%s:%d", reg.SeqName, reg.Start+1)
 	}
+	return fmt.Sprintf("%s:%d-%d", reg.SeqName, reg.Start+1, reg.End)
+}
 
-	log.Println("Seq", sd.SeqName, "READING")
-	ReadFileLineByLine(file, processFastaLine)
 
-	log.Println("Seq", sd.SeqName, "CONVERTING")
-	sd.Sequence = []byte(buffer.String())
 
-	return sd
-}
+/*
+ParseRegion: parses a samtools style region string: name, name:start or
+             name:start-end. coordinates are 1-based and inclusive and may
+             contain thousands separators
+input      : region string
+return     : reg    *Region
+             err    error
+*/
+func ParseRegion(region string) (reg *Region, err error) {
+	reg = &Region{ SeqName: region, Start: 0, End: -1 }
 
-func OpenAndSeek(filename string, position int64) (file *os.File) {
-        file, err := os.Open(filename)
-	check(err)
+	colon := strings.LastIndex(region, ":")
+	if colon == -1 {
+		return reg, nil
+	}
 
-        _, err  = file.Stat()
-	check(err)
+	coords := strings.Replace(region[colon+1:], ",", "", -1)
+	reg.SeqName = region[:colon]
 
-	//log.Println(d)
+	if reg.SeqName == "" {
+		return nil, fmt.Errorf("%w: region '%s' has no sequence name", ErrInvalidSeq, region)
+	}
 
-	_, err = file.Seek(position, 0)
-	check(err)
+	startStr := coords
+	endStr   := ""
+	if dash := strings.Index(coords, "-"); dash != -1 {
+		startStr = coords[:dash]
+		endStr   = coords[dash+1:]
+	}
 
-	return file
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 1 {
+		return nil, fmt.Errorf("%w: region '%s' has invalid start", ErrInvalidSeq, region)
+	}
+	reg.Start = start - 1
+
+	if endStr != "" {
+		end, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("%w: region '%s' has invalid end", ErrInvalidSeq, region)
+		}
+		reg.End = end
+	}
+
+	return reg, nil
 }
 
 
+
 /*
-ReadFastaSeq: read a fasta Sequence inside a file
-input       : filename string
-              position string
-return      : sd       *SeqData
+ParseIndexRegion: as ParseRegion, but a region that is the whole name of a
+                  sequence of the index is read as that sequence, as samtools
+                  does, so that names with colons (HLA-A*01:01:01:01) are not
+                  taken for coordinates
+input           : ix     *fastaindex.Index
+                  region string
+return          : reg    *Region
+                  err    error
 */
-func ReadFastaSeq(filename string, position int64) (sd *SeqData) {
-	file := OpenAndSeek(filename, position)
-	defer file.Close()
+func ParseIndexRegion(ix *fastaindex.Index, region string) (reg *Region, err error) {
+	if ix.ByName(region) != nil {
+		return &Region{ SeqName: region, Start: 0, End: -1 }, nil
+	}
+	return ParseRegion(region)
+}
 
-	//log.Println("new positions", pos)
 
-	sd   = readSeqFromFasta(file)
 
-	sd.Print()
+/*
+FetchRegion: reads an interval of a sequence seeking directly to its
+             position using the line layout stored in the index
+input      : filename string
+             ix       *fastaindex.Index
+             seqName  string
+             start    int64 - 0-based, inclusive
+             end      int64 - 0-based, exclusive. -1 for the end of the sequence
+return     : sd       *SeqData
+             err      error
+*/
+func FetchRegion(filename string, ix *fastaindex.Index, seqName string, start int64, end int64) (sd *SeqData, err error) {
+	idx := ix.ByName(seqName)
+	if idx == nil {
+		return nil, fmt.Errorf("%w: %s: sequence '%s' not found in index", ErrInvalidSeq, filename, seqName)
+	}
 
-	return sd
+	return FetchIdxRegion(filename, idx, start, end)
 }
 
 
 
-//func(string)bool
-func ReadFastaSeqIter(filename string, position int64, clbk func(*string)bool) {
-	file := OpenAndSeek(filename, position)
-	defer file.Close()
+/*
+FetchIdxRegion: reads an interval of the sequence of an index record
+input         : filename string
+                idx      *fastaindex.IdxData
+                start    int64 - 0-based, inclusive
+                end      int64 - 0-based, exclusive. -1 for the end of the sequence
+return        : sd       *SeqData
+                err      error
+*/
+func FetchIdxRegion(filename string, idx *fastaindex.IdxData, start int64, end int64) (sd *SeqData, err error) {
+	seqName := idx.SeqName
 
-	log.Println("ReadFastaSeqIter :: filename:", filename, "position:", position)
+	if ! idx.HasLineLayout() {
+		return nil, fmt.Errorf("%w: %s: sequence '%s' has lines of irregular lengths. its regions can not be fetched through the index", fastaindex.ErrInvalidIdx, filename, seqName)
+	}
 
-	//kmertools.GetExtractKmersIterClbk( kmerSize, data))
+	if end == -1 || end > idx.SeqSize {
+		end = idx.SeqSize
+	}
 
-	ReadFileLineByLine(file, clbk)
+	if start < 0 || start > end {
+		return nil, fmt.Errorf("%w: %s: invalid interval %d-%d for '%s'", ErrInvalidSeq, filename, start, end, seqName)
+	}
 
-	log.Println("ReadFastaSeqIter :: filename:", filename, "position:", position, "DONE")
-}
+	sd          = new(SeqData)
+	sd.SeqName  = (&Region{ SeqName: seqName, Start: start, End: end }).String()
+	sd.Sequence = make([]byte, 0, end - start)
 
+	if start == end {
+		return sd, nil
+	}
 
-func GetPipeFastaBackClbk( of *os.File ) func(*string)bool {
-	seqName               := ""
+	first := idx.BaseOffset(start)
+	last  := idx.BaseOffset(end - 1)
 
-	pipeFastaBackIterClbk := func(line *string)bool {
-                if (*line)[0] == '>' {
-                        if seqName == "" { // first
-                                seqName = strings.TrimSpace((*line)[1:])
-                                log.Println("Seq", seqName, "STARTING")
-				of.WriteString( string(*line) + "\n" )
-                                return true
+	file, err := OpenAndSeek(filename, first)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-                        } else { //next
-                                log.Println("Seq", seqName, "DONE"    )
-                                return false
+	buf    := make([]byte, last - first + 1)
+	if _, err = io.ReadFull(file, buf); err != nil {
+		return nil, fmt.Errorf("%w: %s: reading '%s' at %d: %w", ErrInvalidSeq, filename, sd.SeqName, first, err)
+	}
 
-                        }
-                } else {
-                        if len(*line) != 0 {
-				of.WriteString( string(*line) + "\n" )
-                        }
+	for _, b := range buf {
+		if b != '\n' && b != '\r' {
+			sd.Sequence = append(sd.Sequence, b)
+		}
+	}
 
-                        return true
-                }
+	if sd.Size() != end - start {
+		return nil, fmt.Errorf("%w: %s: expected %d bases in '%s', found %d", ErrInvalidSeq, filename, end - start, sd.SeqName, sd.Size())
 	}
 
-	return pipeFastaBackIterClbk
+	return sd, nil
+}
+
+
+
+/*
+FetchRegionOneBased: reads an interval of a sequence using 1-based,
+                     closed coordinates
+input              : filename string
+                     ix       *fastaindex.Index
+                     seqName  string
+                     start    int64 - 1-based, inclusive
+                     end      int64 - 1-based, inclusive. -1 for the end of the sequence
+return             : sd       *SeqData
+                     err      error
+*/
+func FetchRegionOneBased(filename string, ix *fastaindex.Index, seqName string, start int64, end int64) (sd *SeqData, err error) {
+	return FetchRegion(filename, ix, seqName, start - 1, end)
 }
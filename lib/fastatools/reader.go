@@ -0,0 +1,322 @@
+package fastatools
+
+// sequential fasta reading over any io.Reader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaindex"
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+)
+
+
+/*
+Reader: reads fasta or fastq records one by one from any io.Reader,
+        including stdin and pipes. the format is detected from the first
+        header. blank lines are skipped
+*/
+type Reader struct {
+	lr        *fastaio.LineReader
+	closer    io.Closer
+	header    []byte // header of the next record, without '>' or '@'
+	hasHeader bool
+	inRecord  bool   // the sequence lines of a fasta record are being read
+	started   bool   // the format has been detected
+	IsFastq   bool
+}
+
+/*
+NewReader: creates a Reader. the reader must be positioned at a header
+           or at blank lines before it
+inputs   : r io.Reader
+outputs  : *Reader
+*/
+func NewReader(r io.Reader) *Reader {
+	return &Reader{ lr: fastaio.NewLineReader(r) }
+}
+
+/*
+LineNum: number of lines read
+outputs: int
+*/
+func (r *Reader) LineNum() int {
+	return r.lr.LineNum
+}
+
+/*
+IsFastq: checks whether a plain or gzip compressed file is fastq by the
+         first character of its first non blank line
+inputs : filename string
+outputs: bool
+         error
+*/
+func IsFastq(filename string) (bool, error) {
+	s, err := fastaio.OpenStream(filename)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidSeq, err)
+	}
+	defer s.Close()
+
+	br := bufio.NewReader(s)
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %s: %w", ErrInvalidSeq, filename, err)
+		}
+
+		if b != '\n' && b != '\r' {
+			return b == '@', nil
+		}
+	}
+}
+
+
+
+/*
+OpenReader: opens a plain or gzip compressed file for sequential reading.
+            "-" reads from stdin
+inputs    : filename string
+outputs   : r        *Reader
+            err      error
+*/
+func OpenReader(filename string) (r *Reader, err error) {
+	s, err := fastaio.OpenStream(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSeq, err)
+	}
+
+	r        = NewReader(s)
+	r.closer = s
+
+	return r, nil
+}
+
+/*
+OpenReaderAt: opens a plain, gzip or bgzf file for reading records from a
+              position of the uncompressed data, usually the position of
+              a record in the index
+inputs      : filename string
+              position int64
+outputs     : r        *Reader
+              err      error
+*/
+func OpenReaderAt(filename string, position int64) (r *Reader, err error) {
+	file, err := OpenAndSeek(filename, position)
+	if err != nil {
+		return nil, err
+	}
+
+	r        = NewReader(file)
+	r.closer = file
+
+	return r, nil
+}
+
+/*
+Close  : closes the file opened by OpenReader or OpenReaderAt
+outputs: err error
+*/
+func (r *Reader) Close() (err error) {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+/*
+Next   : reads the next record. fastq records have their quality set
+outputs: sd  *SeqData
+         err error - io.EOF after the last record
+*/
+func (r *Reader) Next() (sd *SeqData, err error) {
+	sd, err = r.NextHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.IsFastq {
+		return r.nextFastq(sd)
+	}
+
+	for {
+		line, err := r.ReadSeqLine()
+		if err == io.EOF {
+			return sd, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sd.Sequence = append(sd.Sequence, line...)
+	}
+}
+
+/*
+NextHeader: reads the header of the next record, skipping what is left of
+            the current one. the sequence of fasta records can then be read
+            line by line with ReadSeqLine, without holding it in memory.
+            fastq records must be read with Next
+outputs   : sd  *SeqData - with an empty sequence
+            err error    - io.EOF after the last record
+*/
+func (r *Reader) NextHeader() (sd *SeqData, err error) {
+	for r.inRecord {
+		if _, err = r.ReadSeqLine(); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	for ! r.hasHeader {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if fastaio.IsBlank(line) {
+			continue
+		}
+
+		if ! r.started {
+			r.started = true
+			r.IsFastq = line[0] == '@'
+		}
+
+		if r.IsFastq && line[0] != '@' {
+			return nil, fmt.Errorf("%w: line %d: expected fastq header", ErrInvalidSeq, r.LineNum())
+		}
+
+		if ! r.IsFastq && line[0] != '>' {
+			return nil, fmt.Errorf("%w: line %d: sequence data before header", ErrInvalidSeq, r.LineNum())
+		}
+
+		r.setHeader(line)
+	}
+
+	sd          = r.newSeqData()
+	r.hasHeader = false
+	r.inRecord  = ! r.IsFastq
+
+	return sd, nil
+}
+
+/*
+ReadSeqLine: reads the next sequence line of the fasta record whose header
+             was read by NextHeader. blank lines are skipped. the line is
+             only valid until the next call
+outputs    : line []byte
+             err  error - io.EOF at the end of the record
+*/
+func (r *Reader) ReadSeqLine() (line []byte, err error) {
+	for r.inRecord {
+		line, err = r.readLine()
+		if err == io.EOF {
+			r.inRecord = false
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if fastaio.IsBlank(line) {
+			continue
+		}
+
+		if line[0] == '>' {
+			r.setHeader(line)
+			r.inRecord = false
+			return nil, io.EOF
+		}
+
+		return line, nil
+	}
+
+	return nil, io.EOF
+}
+
+/*
+nextFastq: reads the sequence and quality of a fastq record whose header
+           has been read. sequence and quality may span several lines
+inputs   : sd  *SeqData - record of the header
+outputs  : sd  *SeqData
+           err error
+*/
+func (r *Reader) nextFastq(sd *SeqData) (*SeqData, error) {
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: line %d: truncated fastq record '%s'", ErrInvalidSeq, r.LineNum(), sd.SeqName)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) != 0 && line[0] == '+' {
+			break
+		}
+
+		sd.Sequence = append(sd.Sequence, line...)
+	}
+
+	// quality lines may start with '@' or '+', so they are read by length
+	sd.Quality = make([]byte, 0, len(sd.Sequence))
+
+	for len(sd.Quality) < len(sd.Sequence) {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: line %d: truncated fastq record '%s'", ErrInvalidSeq, r.LineNum(), sd.SeqName)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sd.Quality = append(sd.Quality, line...)
+	}
+
+	if len(sd.Quality) != len(sd.Sequence) {
+		return nil, fmt.Errorf("%w: line %d: quality length %d differs from sequence length %d in '%s'", ErrInvalidSeq, r.LineNum(), len(sd.Quality), len(sd.Sequence), sd.SeqName)
+	}
+
+	return sd, nil
+}
+
+/*
+newSeqData: creates an empty record with the id and description of the
+            header read
+outputs   : sd *SeqData
+*/
+func (r *Reader) newSeqData() (sd *SeqData) {
+	sd = &SeqData{ Sequence: make([]byte, 0) }
+	sd.SeqName, sd.SeqDesc = fastaindex.SplitHeader(string(r.header))
+	return sd
+}
+
+func (r *Reader) setHeader(line []byte) {
+	r.header    = append(r.header[:0], bytes.TrimSpace(line[1:])...)
+	r.hasHeader = true
+}
+
+/*
+readLine: reads a line of any length, without its line terminator.
+          the line is only valid until the next call
+outputs : line []byte
+          err  error - io.EOF if there are no more lines
+*/
+func (r *Reader) readLine() (line []byte, err error) {
+	line, _, err = r.lr.ReadLine()
+
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: line %d: %w", ErrInvalidSeq, r.LineNum() + 1, err)
+	}
+
+	return line, err
+}
@@ -0,0 +1,115 @@
+package fastatools
+
+// buffered fasta writing with configurable line width
+
+import (
+	"bufio"
+	"io"
+)
+
+
+// Line width used by SaveToFasta
+const DefaultLineWidth = 80
+
+
+/*
+Writer: writes fasta records to any io.Writer, wrapping sequences at a
+        fixed number of bases per line. sequences can be written in pieces,
+        so that large sequences do not have to be held in memory. Flush
+        must be called after the last record
+*/
+type Writer struct {
+	bw        *bufio.Writer
+	LineWidth int // bases per line. 0 writes each sequence in a single line
+	col       int // bases in the current line
+}
+
+/*
+NewWriter: creates a Writer
+inputs   : w         io.Writer
+           lineWidth int - 0 for single line sequences
+outputs  : *Writer
+*/
+func NewWriter(w io.Writer, lineWidth int) *Writer {
+	return &Writer{ bw: bufio.NewWriter(w), LineWidth: lineWidth }
+}
+
+/*
+endLine: terminates the current sequence line, if any
+outputs: err error
+*/
+func (w *Writer) endLine() (err error) {
+	if w.col == 0 {
+		return nil
+	}
+	w.col = 0
+	return w.bw.WriteByte('\n')
+}
+
+/*
+WriteHeader: starts a new record
+inputs     : header string - without '>'
+outputs    : err    error
+*/
+func (w *Writer) WriteHeader(header string) (err error) {
+	if err = w.endLine(); err != nil {
+		return err
+	}
+	if err = w.bw.WriteByte('>'); err != nil {
+		return err
+	}
+	if _, err = w.bw.WriteString(header); err != nil {
+		return err
+	}
+	return w.bw.WriteByte('\n')
+}
+
+/*
+WriteSeq: appends bases to the sequence of the current record
+inputs  : seq []byte
+outputs : err error
+*/
+func (w *Writer) WriteSeq(seq []byte) (err error) {
+	for len(seq) > 0 {
+		n := len(seq)
+		if w.LineWidth > 0 && n > w.LineWidth - w.col {
+			n = w.LineWidth - w.col
+		}
+
+		if _, err = w.bw.Write(seq[:n]); err != nil {
+			return err
+		}
+		w.col += n
+		seq    = seq[n:]
+
+		if w.LineWidth > 0 && w.col == w.LineWidth {
+			if err = w.endLine(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Write  : writes a whole record
+inputs : seqd *SeqData
+outputs: err  error
+*/
+func (w *Writer) Write(seqd *SeqData) (err error) {
+	if err = w.WriteHeader(seqd.Header()); err != nil {
+		return err
+	}
+	return w.WriteSeq(seqd.Sequence)
+}
+
+/*
+Flush  : terminates the last line and writes the buffered data
+outputs: err error
+*/
+func (w *Writer) Flush() (err error) {
+	if err = w.endLine(); err != nil {
+		return err
+	}
+	return w.bw.Flush()
+}
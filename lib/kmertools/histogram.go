@@ -0,0 +1,271 @@
+package kmertools
+
+// kmer count spectrum (histogram of counts) and the estimates derived from it
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+)
+
+
+// Largest count with a bin of its own. as in jellyfish, higher counts are
+// added to the last bin
+const DefaultHistoMax = 10000
+
+
+/*
+Histogram: number of distinct kmers seen each number of times, the kmer
+           spectrum. Bins[i] holds the kmers seen i times, Bins[0] is
+           always 0 and the last bin holds the kmers seen at least that
+           many times
+*/
+type Histogram struct {
+	KmerSize int
+	Bins     []uint64
+}
+
+/*
+Histogram: computes the spectrum of the kmers counted
+inputs   : maxCount int - last bin. see DefaultHistoMax
+outputs  : h        *Histogram
+           err      error
+*/
+func (c *Data) Histogram(maxCount int) (h *Histogram, err error) {
+	if maxCount < 1 {
+		return nil, fmt.Errorf("%w: histogram maximum count %d must be greater than 0", ErrInternal, maxCount)
+	}
+
+	h = &Histogram{ KmerSize: c.KmerSize, Bins: make([]uint64, maxCount + 1) }
+
+	err = c.EachWords(func(words []uint64, count int) error {
+		if count > maxCount {
+			count = maxCount
+		}
+		h.Bins[count]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+/*
+Write  : writes the non empty bins as "count<tab>kmers" lines, without a
+         header, as read by GenomeScope
+inputs : w   io.Writer
+outputs: err error
+*/
+func (h *Histogram) Write(w io.Writer) (err error) {
+	for count, kmers := range h.Bins {
+		if kmers == 0 {
+			continue
+		}
+		if _, err = fmt.Fprintf(w, "%d\t%d\n", count, kmers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+SaveAs : writes the histogram to a file
+inputs : outFileName string
+outputs: err         error
+*/
+func (h *Histogram) SaveAs(outFileName string) (err error) {
+	fo, err := fastaio.CreateTemp(outFileName)
+	if err != nil {
+		return err
+	}
+	defer fastaio.DiscardTemp(fo)
+
+	bw      := bufio.NewWriter(fo)
+
+	if err = h.Write(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", outFileName, err)
+	}
+
+	return fastaio.CommitTemp(fo, outFileName)
+}
+
+
+/*
+SpectrumSummary: estimates from the kmer spectrum, in the spirit of
+                 GenomeScope but without fitting a model, so they are only
+                 rough. coverages are in kmer counts, not in bases
+*/
+type SpectrumSummary struct {
+	ErrorTrough    int     // first minimum of the spectrum. kmers seen fewer times are taken as errors
+	PeakCoverage   int     // count of the homozygous peak, the coverage of the whole genome
+	HetPeak        int     // count of the heterozygous peak, about half PeakCoverage. 0 if not found
+	SolidKmers     uint64  // kmers seen at least ErrorTrough times, counting repetitions
+	GenomeSize     int64   // haploid genome size. SolidKmers / PeakCoverage
+	Heterozygosity float64 // fraction of heterozygous bases. 0 if HetPeak is 0
+}
+
+/*
+Write  : writes the summary as "name<tab>value" lines
+inputs : w   io.Writer
+outputs: err error
+*/
+func (s *SpectrumSummary) Write(w io.Writer) (err error) {
+	_, err = fmt.Fprintf(w, "error_trough\t%d\npeak_coverage\t%d\nhet_peak\t%d\nsolid_kmers\t%d\ngenome_size\t%d\nheterozygosity\t%.6f\n",
+		s.ErrorTrough, s.PeakCoverage, s.HetPeak, s.SolidKmers, s.GenomeSize, s.Heterozygosity)
+	return err
+}
+
+/*
+Log    : logs the summary
+*/
+func (s *SpectrumSummary) Log() {
+	log.Println("Error trough  ", s.ErrorTrough)
+	log.Println("Peak coverage ", s.PeakCoverage)
+	log.Println("Het peak      ", s.HetPeak)
+	log.Println("Solid kmers   ", s.SolidKmers)
+	log.Println("Genome size   ", s.GenomeSize)
+	log.Printf ("Heterozygosity %.4f%%\n", 100 * s.Heterozygosity)
+}
+
+/*
+smoothed: the bins averaged over a window of 3, so that the noise of low
+          coverage spectra does not create peaks. the last bin, which
+          gathers the highest counts, is left out
+outputs : []float64
+*/
+func (h *Histogram) smoothed() []float64 {
+	n := len(h.Bins) - 1
+	s := make([]float64, n)
+
+	for i := 1; i < n; i++ {
+		sum := float64(h.Bins[i])
+		cnt := 1.0
+		if i > 1 {
+			sum += float64(h.Bins[i-1])
+			cnt++
+		}
+		if i + 1 < n {
+			sum += float64(h.Bins[i+1])
+			cnt++
+		}
+		s[i] = sum / cnt
+	}
+
+	return s
+}
+
+/*
+localPeak: highest local maximum of the smoothed spectrum between two
+           counts, ignoring those lower than a fraction of a reference
+           height
+inputs   : s      []float64
+           lo     int
+           hi     int
+           height float64
+outputs  : int - 0 if there is none
+*/
+func localPeak(s []float64, lo int, hi int, height float64) int {
+	if lo < 2 {
+		lo = 2
+	}
+	if hi > len(s) - 2 {
+		hi = len(s) - 2
+	}
+
+	peak := 0
+	for i := lo; i <= hi; i++ {
+		if s[i] > s[i-1] && s[i] >= s[i+1] && s[i] >= height && (peak == 0 || s[i] > s[peak]) {
+			peak = i
+		}
+	}
+
+	return peak
+}
+
+/*
+Summary: estimates the coverage, the genome size and the heterozygosity.
+         the spectrum of a diploid genome has a peak at the coverage of
+         the kmers shared by both haplotypes and, the more heterozygous
+         it is, one at half that coverage, of the kmers of a single
+         haplotype. whichever of the two is the highest, the other is
+         looked for at twice or half its count
+outputs: s   *SpectrumSummary
+         err error - ErrNoPeak if the spectrum only decreases
+*/
+func (h *Histogram) Summary() (s *SpectrumSummary, err error) {
+	sm := h.smoothed()
+	n  := len(sm)
+
+	s   = &SpectrumSummary{}
+
+	for i := 1; i + 1 < n; i++ {
+		if sm[i+1] > sm[i] {
+			s.ErrorTrough = i
+			break
+		}
+	}
+	if s.ErrorTrough == 0 {
+		return nil, fmt.Errorf("%w: the spectrum decreases from count 1 to %d", ErrNoPeak, n - 1)
+	}
+
+	top := s.ErrorTrough
+	for i := s.ErrorTrough; i < n; i++ {
+		if sm[i] > sm[top] {
+			top = i
+		}
+	}
+
+	// secondary peaks lower than this are taken as noise
+	minHeight := sm[top] / 10
+
+	if p := localPeak(sm, int(math.Round(1.7 * float64(top))), int(math.Round(2.3 * float64(top))), minHeight); p != 0 {
+		s.HetPeak      = top
+		s.PeakCoverage = p
+	} else
+	if p := localPeak(sm, int(math.Round(0.4 * float64(top))), int(math.Round(0.6 * float64(top))), minHeight); p > s.ErrorTrough {
+		s.HetPeak      = p
+		s.PeakCoverage = top
+	} else {
+		s.PeakCoverage = top
+	}
+
+	for count := s.ErrorTrough; count < len(h.Bins); count++ {
+		s.SolidKmers += uint64(count) * h.Bins[count]
+	}
+	s.GenomeSize = int64(s.SolidKmers / uint64(s.PeakCoverage))
+
+	// each heterozygous base gives KmerSize kmers of a single haplotype
+	// in each of the two haplotypes
+	if s.HetPeak != 0 && s.GenomeSize > 0 {
+		valley := s.HetPeak
+		for i := s.HetPeak; i <= s.PeakCoverage; i++ {
+			if sm[i] < sm[valley] {
+				valley = i
+			}
+		}
+
+		hetKmers := uint64(0)
+		for count := s.ErrorTrough; count < valley; count++ {
+			hetKmers += h.Bins[count]
+		}
+
+		s.Heterozygosity = float64(hetKmers) / float64(2 * h.KmerSize) / float64(s.GenomeSize)
+		if s.Heterozygosity > 1 {
+			s.Heterozygosity = 1
+		}
+	}
+
+	return s, nil
+}
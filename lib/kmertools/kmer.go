@@ -0,0 +1,174 @@
+package kmertools
+
+// 2 bit packed kmers
+
+import (
+	"fmt"
+)
+
+
+// Largest kmer size that fits in a Kmer
+const MaxKmerSize = 32
+
+
+/*
+Kmer: a kmer packed 2 bits per base, first base in the most significant
+      bits. A=0 C=1 G=2 T=3, so comparing two Kmers of the same size gives
+      the same result as comparing their strings
+*/
+type Kmer uint64
+
+
+/*
+baseCodes: 2 bit code of each base. -1 for bases that break kmers.
+           as in the string based extraction, only upper case ACGT are
+           valid. soft masked (lower case) bases break kmers as N does
+*/
+var baseCodes = func() (codes [256]int8) {
+	for i := range codes {
+		codes[i] = -1
+	}
+	codes['A'] = 0
+	codes['C'] = 1
+	codes['G'] = 2
+	codes['T'] = 3
+	return codes
+}()
+
+var codeBases = [4]byte{ 'A', 'C', 'G', 'T' }
+
+
+/*
+EncodeKmer: packs a sequence of up to MaxKmerSize bases
+inputs    : seq  []byte
+outputs   : kmer Kmer
+            err  error
+*/
+func EncodeKmer(seq []byte) (kmer Kmer, err error) {
+	if len(seq) > MaxKmerSize {
+		return 0, fmt.Errorf("%w: kmer size %d larger than %d", ErrInvalidSeq, len(seq), MaxKmerSize)
+	}
+
+	for i, b := range seq {
+		code := baseCodes[b]
+		if code < 0 {
+			return 0, fmt.Errorf("%w: invalid base '%c' at position %d of '%s'", ErrInvalidSeq, b, i, seq)
+		}
+		kmer = kmer << 2 | Kmer(code)
+	}
+
+	return kmer, nil
+}
+
+
+/*
+Decode : unpacks a kmer
+inputs : kmerSize int
+outputs: []byte
+*/
+func (k Kmer) Decode(kmerSize int) []byte {
+	seq := make([]byte, kmerSize)
+	for i := kmerSize - 1; i >= 0; i-- {
+		seq[i] = codeBases[k & 3]
+		k    >>= 2
+	}
+	return seq
+}
+
+
+/*
+String : unpacks a kmer as a string
+inputs : kmerSize int
+outputs: string
+*/
+func (k Kmer) String(kmerSize int) string {
+	return string(k.Decode(kmerSize))
+}
+
+
+/*
+ReverseComplement: reverse complement of a packed kmer
+inputs           : kmerSize int
+outputs          : Kmer
+*/
+func (k Kmer) ReverseComplement(kmerSize int) (rc Kmer) {
+	for i := 0; i < kmerSize; i++ {
+		rc   = rc << 2 | (3 - k & 3)
+		k  >>= 2
+	}
+	return rc
+}
+
+
+/*
+KmerRoller: packs the kmers of a sequence one base at a time, keeping
+            both the forward kmer and its reverse complement
+*/
+type KmerRoller struct {
+	KmerSize int
+	Fwd      Kmer
+	Rev      Kmer
+	mask     Kmer
+	shift    uint
+	valid    int // number of valid bases since the last invalid one
+}
+
+/*
+NewKmerRoller: creates a roller for kmers of a given size
+inputs       : kmerSize int
+outputs      : r        *KmerRoller
+               err      error
+*/
+func NewKmerRoller(kmerSize int) (r *KmerRoller, err error) {
+	if kmerSize < 1 || kmerSize > MaxKmerSize {
+		return nil, fmt.Errorf("%w: kmer size %d out of range 1-%d", ErrInvalidSeq, kmerSize, MaxKmerSize)
+	}
+
+	// for MaxKmerSize the shift overflows to 0 and the mask has all bits set
+	r = &KmerRoller{ KmerSize: kmerSize, shift: uint(2 * (kmerSize - 1)) }
+	r.mask = Kmer(1) << uint(2 * kmerSize) - 1
+
+	return r, nil
+}
+
+/*
+Reset  : forgets the bases pushed so far, as at the start of a new sequence
+*/
+func (r *KmerRoller) Reset() {
+	r.Fwd   = 0
+	r.Rev   = 0
+	r.valid = 0
+}
+
+/*
+Push   : adds a base to the end of the kmer. invalid bases restart it
+inputs : b byte
+outputs: full bool - true if the last KmerSize bases were all valid
+*/
+func (r *KmerRoller) Push(b byte) (full bool) {
+	code := baseCodes[b]
+	if code < 0 {
+		r.valid = 0
+		return false
+	}
+
+	r.Fwd = (r.Fwd << 2 | Kmer(code)) & r.mask
+	r.Rev =  r.Rev >> 2 | Kmer(3 - code) << r.shift
+
+	if r.valid < r.KmerSize {
+		r.valid++
+	}
+
+	return r.valid == r.KmerSize
+}
+
+/*
+Canonical: the smaller of the forward kmer and its reverse complement
+outputs  : Kmer
+*/
+func (r *KmerRoller) Canonical() Kmer {
+	if r.Fwd < r.Rev {
+		return r.Fwd
+	}
+	return r.Rev
+}
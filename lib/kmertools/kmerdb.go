@@ -0,0 +1,508 @@
+package kmertools
+
+// binary kmer database: sorted packed kmers and their counts, queried from
+// disk through a prefix index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+
+import (
+	"github.com/sauloalgolang/fastareader/lib/fastaio"
+)
+
+
+/*
+Layout of the database. all integers are big endian
+
+	magic        [8]byte  "KMERDB01"
+	kmer size    uint32
+	words        uint32   64 bit words per kmer. see KmerWords
+	prefix bases uint32   bases of the prefix index
+	counts       uint32   counts per record. 1, or 2 in mode both
+	mode         uint16 length, bytes
+	sources      uint32 number, then uint32 length, bytes of each
+	kmers        uint64   number of records
+	index offset uint64
+	records      kmers x (words x uint64, counts x uint32), sorted by kmer
+	index        4^prefix bases + 1 uint64, the first record of each prefix
+
+the words of a kmer are big endian, so the records sort as the bytes and as
+the kmer strings. in mode both the kmers are canonical, with the count of the
+forward and of the reverse strand. counts larger than a uint32 are saved as
+the largest uint32
+*/
+const kmerDBMagic = "KMERDB01"
+
+// Largest prefix of the index. 4^10 entries of 8 bytes, 8Mb
+const maxPrefixBases = 10
+
+// Kmers per prefix of the index the prefix size aims for
+const kmersPerPrefix = 16
+
+// Largest number of counts per record
+const maxDBCounts = 2
+
+// Error returned by files that are not kmer databases
+var ErrInvalidDB = errors.New("kmertools: invalid kmer database")
+
+
+/*
+prefixBasesFor: bases of the prefix index of a database
+inputs        : kmerSize int
+                kmers    int - expected number of kmers
+outputs       : int
+*/
+func prefixBasesFor(kmerSize int, kmers int) int {
+	bases := 0
+	for bases < maxPrefixBases && bases < kmerSize && int64(kmersPerPrefix) << uint(2 * (bases + 1)) <= int64(kmers) {
+		bases++
+	}
+	return bases
+}
+
+/*
+kmerPrefix: the first bases of a kmer packed in words, packed
+inputs    : words    []uint64
+            kmerSize int
+            bases    int
+outputs   : prefix   uint64
+*/
+func kmerPrefix(words []uint64, kmerSize int, bases int) (prefix uint64) {
+	topBases := kmerSize - (len(words) - 1) * wordBases
+
+	for i := 0; i < bases; i++ {
+		w, pos := 0, topBases - 1 - i
+		if i >= topBases {
+			j      := i - topBases
+			w, pos  = 1 + j / wordBases, wordBases - 1 - j % wordBases
+		}
+		prefix = prefix << 2 | (words[w] >> uint(2 * pos)) & 3
+	}
+
+	return prefix
+}
+
+
+/*
+SaveDB : saves the kmers selected by the options as a kmer database. the
+         database is sorted by kmer, so the options can not sort by count
+         nor keep only the top kmers. see OpenKmerDB
+inputs : outFileName string
+         opts        SaveOptions
+outputs: err         error
+*/
+func (c *Data) SaveDB(outFileName string, opts SaveOptions) (err error) {
+	if opts.Sort == SortCount || opts.Top > 0 {
+		return fmt.Errorf("%w: kmer databases are sorted by kmer. sort by count and top are not supported", ErrInternal)
+	}
+	opts.Sort = SortKmer
+
+	if err = opts.check(); err != nil {
+		return err
+	}
+
+	prefixBases := prefixBasesFor(c.KmerSize, c.Len())
+
+	nCounts     := 1
+	if c.Mode == ModeBoth {
+		nCounts = 2
+	}
+
+	// header, up to the number of kmers and the index offset
+	var hdr bytes.Buffer
+	hdr.WriteString(kmerDBMagic)
+	binary.Write(&hdr, binary.BigEndian, uint32(c.KmerSize))
+	binary.Write(&hdr, binary.BigEndian, uint32(c.words))
+	binary.Write(&hdr, binary.BigEndian, uint32(prefixBases))
+	binary.Write(&hdr, binary.BigEndian, uint32(nCounts))
+	binary.Write(&hdr, binary.BigEndian, uint16(len(c.Mode)))
+	hdr.WriteString(c.Mode)
+	binary.Write(&hdr, binary.BigEndian, uint32(len(c.Sources)))
+	for _, src := range c.Sources {
+		binary.Write(&hdr, binary.BigEndian, uint32(len(src)))
+		hdr.WriteString(src)
+	}
+
+	tailPos    := int64(hdr.Len())
+	hdr.Write(make([]byte, 16)) // kmers and index offset, written at the end
+
+	fo, err    := fastaio.CreateTemp(outFileName)
+	if err != nil {
+		return err
+	}
+	defer fastaio.DiscardTemp(fo)
+
+	bw         := bufio.NewWriter(fo)
+	if _, err = bw.Write(hdr.Bytes()); err != nil {
+		return fmt.Errorf("%s: %w", outFileName, err)
+	}
+
+	starts     := make([]uint64, (1 << uint(2 * prefixBases)) + 1)
+	rec        := make([]byte, 8 * c.words + 4 * nCounts)
+	kmers      := uint64(0)
+
+	err = c.eachSelected(opts, func(words []uint64, value int) (err error) {
+		for i, w := range words {
+			binary.BigEndian.PutUint64(rec[8*i:], w)
+		}
+
+		fwd, rev := c.counts(value)
+		for i, count := range []int{ fwd, rev }[:nCounts] {
+			saved := uint32(math.MaxUint32)
+			if uint64(count) <= math.MaxUint32 {
+				saved = uint32(count)
+			}
+			binary.BigEndian.PutUint32(rec[8*len(words) + 4*i:], saved)
+		}
+
+		starts[kmerPrefix(words, c.KmerSize, prefixBases) + 1]++
+		kmers++
+
+		_, err = bw.Write(rec)
+		return err
+	})
+
+	// the counts of each prefix become the first record of each prefix
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+
+	if err == nil {
+		err = binary.Write(bw, binary.BigEndian, starts)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if err == nil {
+		tail := make([]byte, 16)
+		binary.BigEndian.PutUint64(tail    , kmers)
+		binary.BigEndian.PutUint64(tail[8:], uint64(int64(hdr.Len()) + int64(kmers) * int64(len(rec))))
+		_, err = fo.WriteAt(tail, tailPos)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", outFileName, err)
+	}
+
+	return fastaio.CommitTemp(fo, outFileName)
+}
+
+
+/*
+KmerDB: a kmer database opened for queries. only the header and the prefix
+        index are held in memory. records are read as needed, so a KmerDB
+        can be queried from several goroutines
+*/
+type KmerDB struct {
+	file        *os.File
+	KmerSize    int
+	Mode        string   // counting mode. see AvailableModes
+	Sources     []string // files the kmers were counted from
+	Kmers       int64    // number of kmers
+	words       int
+	counts      int      // counts per record
+	recSize     int64
+	dataOffset  int64
+	prefixBases int
+	index       []uint64
+}
+
+/*
+OpenKmerDB: opens a kmer database saved by SaveDB
+inputs    : filename string
+outputs   : db       *KmerDB
+            err      error
+*/
+func OpenKmerDB(filename string) (db *KmerDB, err error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err  = readKmerDBHeader(fi)
+	if err != nil {
+		fi.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	db.file  = fi
+
+	return db, nil
+}
+
+/*
+readKmerDBHeader: reads the header and the prefix index of a database
+inputs          : fi *os.File
+outputs         : db *KmerDB
+                  err error
+*/
+func readKmerDBHeader(fi *os.File) (db *KmerDB, err error) {
+	st, err := fi.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	br      := bufio.NewReader(io.NewSectionReader(fi, 0, st.Size()))
+	read    := func(v interface{}) {
+		if err == nil {
+			err = binary.Read(br, binary.BigEndian, v)
+		}
+	}
+	readStr := func(n int) (s string) {
+		if err == nil {
+			buf := make([]byte, n)
+			_, err = io.ReadFull(br, buf)
+			s      = string(buf)
+		}
+		return s
+	}
+
+	if magic := readStr(len(kmerDBMagic)); err != nil || magic != kmerDBMagic {
+		return nil, fmt.Errorf("%w: not a kmer database", ErrInvalidDB)
+	}
+
+	var kmerSize, words, prefixBases, nCounts, nSources uint32
+	var modeLen uint16
+	var kmers, indexOffset uint64
+
+	read(&kmerSize)
+	read(&words)
+	read(&prefixBases)
+	read(&nCounts)
+	read(&modeLen)
+	mode := readStr(int(modeLen))
+	read(&nSources)
+
+	if err == nil && (kmerSize == 0 || int(words) != KmerWords(int(kmerSize)) || prefixBases > maxPrefixBases || nCounts < 1 || nCounts > maxDBCounts || (mode == ModeBoth) != (nCounts == 2) || int64(nSources) > st.Size()) {
+		return nil, fmt.Errorf("%w: invalid header", ErrInvalidDB)
+	}
+
+	sources := make([]string, 0)
+	for i := uint32(0); i < nSources && err == nil; i++ {
+		var srcLen uint32
+		read(&srcLen)
+		if int64(srcLen) > st.Size() {
+			return nil, fmt.Errorf("%w: invalid source name", ErrInvalidDB)
+		}
+		sources = append(sources, readStr(int(srcLen)))
+	}
+
+	read(&kmers)
+	read(&indexOffset)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: truncated header: %v", ErrInvalidDB, err)
+	}
+
+	db = &KmerDB{
+		KmerSize   : int(kmerSize),
+		Mode       : mode,
+		Sources    : sources,
+		Kmers      : int64(kmers),
+		words      : int(words),
+		counts     : int(nCounts),
+		recSize    : 8 * int64(words) + 4 * int64(nCounts),
+		prefixBases: int(prefixBases),
+		index      : make([]uint64, (1 << uint(2 * prefixBases)) + 1),
+	}
+	db.dataOffset = int64(indexOffset) - db.Kmers * db.recSize
+
+	if int64(indexOffset) + 8 * int64(len(db.index)) != st.Size() || db.dataOffset < 0 {
+		return nil, fmt.Errorf("%w: size %d does not match %d kmers", ErrInvalidDB, st.Size(), kmers)
+	}
+
+	ir      := io.NewSectionReader(fi, int64(indexOffset), 8 * int64(len(db.index)))
+	if err = binary.Read(bufio.NewReader(ir), binary.BigEndian, db.index); err != nil {
+		return nil, fmt.Errorf("%w: truncated index: %v", ErrInvalidDB, err)
+	}
+
+	if db.index[len(db.index)-1] != kmers {
+		return nil, fmt.Errorf("%w: index does not match %d kmers", ErrInvalidDB, kmers)
+	}
+
+	return db, nil
+}
+
+/*
+Close  : closes the database file
+outputs: error
+*/
+func (db *KmerDB) Close() error {
+	return db.file.Close()
+}
+
+/*
+LookupWords: count of a kmer packed in words, as saved. for canonical and
+             both databases the kmer must be canonical, and the count adds
+             both strands. see Lookup
+inputs     : words []uint64
+outputs    : count int - 0 if not present
+             err   error
+*/
+func (db *KmerDB) LookupWords(words []uint64) (count int, err error) {
+	fwd, rev, err := db.lookupCounts(words)
+	return fwd + rev, err
+}
+
+/*
+lookupCounts: counts of a kmer packed in words, as saved. rev is 0 out of
+              mode both
+inputs      : words []uint64
+outputs     : fwd   int - 0 if not present
+              rev   int
+              err   error
+*/
+func (db *KmerDB) lookupCounts(words []uint64) (fwd int, rev int, err error) {
+	if len(words) != db.words {
+		return 0, 0, fmt.Errorf("%w: kmer of %d words in a database of %d", ErrInternal, len(words), db.words)
+	}
+
+	prefix := kmerPrefix(words, db.KmerSize, db.prefixBases)
+	lo, hi := int64(db.index[prefix]), int64(db.index[prefix+1])
+
+	rec    := make([]byte, db.recSize)
+	found  := make([]uint64, db.words)
+
+	for lo < hi {
+		mid := lo + (hi - lo) / 2
+
+		if _, err = db.file.ReadAt(rec, db.dataOffset + mid * db.recSize); err != nil {
+			return 0, 0, fmt.Errorf("%w: reading kmer %d: %v", ErrInvalidDB, mid, err)
+		}
+		for i := range found {
+			found[i] = binary.BigEndian.Uint64(rec[8*i:])
+		}
+
+		switch CompareKmerWords(found, words) {
+		case 0:
+			fwd = int(binary.BigEndian.Uint32(rec[8*db.words:]))
+			if db.counts > 1 {
+				rev = int(binary.BigEndian.Uint32(rec[8*db.words + 4:]))
+			}
+			return fwd, rev, nil
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return 0, 0, nil
+}
+
+/*
+Lookup : count of a kmer. for canonical and both databases, the count of
+         the smaller of the kmer and its reverse complement
+inputs : kmer  string
+outputs: count int - 0 if not present
+         err   error
+*/
+func (db *KmerDB) Lookup(kmer string) (count int, err error) {
+	words, _, err := db.encode(kmer)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.LookupWords(words)
+}
+
+/*
+LookupStrands: counts of each strand of a kmer, in a both database
+inputs       : kmer string
+outputs      : fwd  int - times the kmer was read. 0 if not present
+               rev  int - times its reverse complement was read
+               err  error
+*/
+func (db *KmerDB) LookupStrands(kmer string) (fwd int, rev int, err error) {
+	if db.Mode != ModeBoth {
+		return 0, 0, fmt.Errorf("%w: database of mode '%s' has no strand counts", ErrInternal, db.Mode)
+	}
+
+	words, swapped, err := db.encode(kmer)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fwd, rev, err = db.lookupCounts(words)
+	if swapped {
+		fwd, rev = rev, fwd
+	}
+
+	return fwd, rev, err
+}
+
+/*
+encode : packs a kmer as saved, canonical for canonical and both databases
+inputs : kmer    string
+outputs: words   []uint64
+         swapped bool - the reverse complement was taken
+         err     error
+*/
+func (db *KmerDB) encode(kmer string) (words []uint64, swapped bool, err error) {
+	if len(kmer) != db.KmerSize {
+		return nil, false, fmt.Errorf("%w: kmer '%s' is not %d bases long", ErrInvalidSeq, kmer, db.KmerSize)
+	}
+
+	words, err = EncodeKmerWords([]byte(kmer))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if db.Mode == ModeCanonical || db.Mode == ModeBoth {
+		rev, err := EncodeKmerWords(ReverseComplement([]byte(kmer)))
+		if err != nil {
+			return nil, false, err
+		}
+		if CompareKmerWords(rev, words) < 0 {
+			return rev, true, nil
+		}
+	}
+
+	return words, false, nil
+}
+
+/*
+QuerySeq: looks up every kmer of a sequence. positions whose kmer has
+          bases other than ACGT are skipped
+inputs  : sequence []byte
+          clbk     func(pos int, count int) error - 0 based start of the kmer
+outputs : err      error - the first error returned by clbk
+*/
+func (db *KmerDB) QuerySeq(sequence []byte, clbk func(pos int, count int) error) (err error) {
+	roller, err := NewKmerRollerWide(db.KmerSize)
+	if err != nil {
+		return err
+	}
+
+	for i, b := range sequence {
+		if ! roller.Push(b) {
+			continue
+		}
+
+		words := roller.Fwd
+		if db.Mode == ModeCanonical || db.Mode == ModeBoth {
+			words = roller.Canonical()
+		}
+
+		count, err := db.LookupWords(words)
+		if err != nil {
+			return err
+		}
+
+		if err = clbk(i - db.KmerSize + 1, count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package kmertools
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+
+/*
+naiveStrandKmers: counts of each strand of the canonical kmers of
+                  sequences, as counted in ModeBoth. palindromes are
+                  counted on the forward strand
+inputs          : seqs     []string
+                  kmerSize int
+outputs         : map[string][2]int - forward and reverse counts
+*/
+func naiveStrandKmers(seqs []string, kmerSize int) map[string][2]int {
+	counts := make(map[string][2]int)
+	for _, seq := range seqs {
+		for i := 0; i + kmerSize <= len(seq); i++ {
+			kmer := seq[i : i+kmerSize]
+			if strings.Contains(kmer, "N") {
+				continue
+			}
+			strand := 0
+			if rc := naiveRevComp(kmer); rc < kmer {
+				kmer   = rc
+				strand = 1
+			}
+			c := counts[kmer]
+			c[strand]++
+			counts[kmer] = c
+		}
+	}
+	return counts
+}
+
+/*
+openSavedDB: counts sequences in a mode, saving and opening them as a kmer
+             database
+inputs     : t        *testing.T
+             seqs     []string
+             kmerSize int
+             mode     string
+outputs    : db       *KmerDB
+*/
+func openSavedDB(t *testing.T, seqs []string, kmerSize int, mode string) *KmerDB {
+	data := &Data{}
+	if err := data.NewMode(kmerSize, mode); err != nil {
+		t.Fatal(err)
+	}
+	data.Sources = []string{ "a.fa", "b.fq.gz" }
+
+	for i, seq := range seqs {
+		if err := ExtractKmersFromSeq([]byte(seq), fmt.Sprint("seq", i), kmerSize, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dbName := filepath.Join(t.TempDir(), "kmers.db")
+	if err := data.SaveDB(dbName, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenKmerDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if db.KmerSize != kmerSize || db.Mode != mode || db.Kmers != int64(data.Len()) || ! reflect.DeepEqual(db.Sources, data.Sources) {
+		t.Fatalf("header: size %d mode '%s' kmers %d sources %v, expected %d '%s' %d %v", db.KmerSize, db.Mode, db.Kmers, db.Sources, kmerSize, mode, data.Len(), data.Sources)
+	}
+
+	return db
+}
+
+
+func TestKmerDB(t *testing.T) {
+	tests := []struct {
+		kmerSize int
+		mode     string
+	}{
+		{ 21, ModeForward   }, { 21, ModeCanonical }, { 21, ModeBoth },
+		{ 40, ModeForward   }, { 40, ModeCanonical }, { 40, ModeBoth },
+	}
+
+	rnd  := rand.New(rand.NewSource(4))
+	seqs := []string{}
+	for i := 0; i < 30; i++ {
+		seqs = append(seqs, randomSeq(rnd, 50 + rnd.Intn(300), 120))
+	}
+	seqs = append(seqs, strings.Repeat("ACGT", 40), strings.Repeat("ACGTTGCA", 20))
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d_%s", tt.kmerSize, tt.mode), func(t *testing.T) {
+			if tt.mode == ModeBoth && bits.UintSize < 2 * strandBits {
+				t.Skip("both mode needs 64 bit integers")
+			}
+
+			db      := openSavedDB(t, seqs, tt.kmerSize, tt.mode)
+
+			countMode := tt.mode
+			if countMode == ModeBoth {
+				countMode = ModeCanonical
+			}
+			want    := naiveKmers(seqs, tt.kmerSize, countMode)
+			strands := naiveStrandKmers(seqs, tt.kmerSize)
+
+			if db.Kmers != int64(len(want)) {
+				t.Fatalf("%d kmers, expected %d", db.Kmers, len(want))
+			}
+
+			// the count of a kmer as read, and of its reverse complement
+			expected := func(kmer string) int {
+				if tt.mode == ModeForward {
+					return want[kmer]
+				}
+				if rc := naiveRevComp(kmer); rc < kmer {
+					return want[rc]
+				}
+				return want[kmer]
+			}
+
+			for _, seq := range seqs {
+				for i := 0; i + tt.kmerSize <= len(seq); i++ {
+					kmer := seq[i : i+tt.kmerSize]
+					if strings.Contains(kmer, "N") {
+						continue
+					}
+
+					for _, query := range []string{ kmer, naiveRevComp(kmer) } {
+						count, err := db.Lookup(query)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if count != expected(query) {
+							t.Fatalf("lookup '%s' %d, expected %d", query, count, expected(query))
+						}
+					}
+
+					if tt.mode != ModeBoth {
+						continue
+					}
+
+					rc      := naiveRevComp(kmer)
+					fwd, rev, err := db.LookupStrands(kmer)
+					if err != nil {
+						t.Fatal(err)
+					}
+					wfwd, wrev := strands[kmer][0], strands[kmer][1]
+					if rc < kmer {
+						wfwd, wrev = strands[rc][1], strands[rc][0]
+					}
+					if fwd != wfwd || rev != wrev {
+						t.Fatalf("strands of '%s' %d %d, expected %d %d", kmer, fwd, rev, wfwd, wrev)
+					}
+				}
+
+				next := 0
+				err  := db.QuerySeq([]byte(seq), func(pos int, count int) error {
+					for ; next < pos; next++ {
+						if ! strings.Contains(seq[next:next+tt.kmerSize], "N") {
+							return fmt.Errorf("position %d skipped", next)
+						}
+					}
+					next++
+
+					kmer := seq[pos : pos+tt.kmerSize]
+					if strings.Contains(kmer, "N") {
+						return fmt.Errorf("position %d has N", pos)
+					}
+					if count != expected(kmer) {
+						return fmt.Errorf("position %d count %d, expected %d", pos, count, expected(kmer))
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// not in the sequences
+			if count, err := db.Lookup(strings.Repeat("C", tt.kmerSize)); err != nil || count != 0 {
+				t.Fatalf("lookup of a missing kmer %d %v", count, err)
+			}
+			if _, err := db.Lookup(strings.Repeat("A", tt.kmerSize - 1)); err == nil {
+				t.Fatal("lookup of a short kmer did not fail")
+			}
+		})
+	}
+}
+
+
+func TestKmerDBSaturation(t *testing.T) {
+	if bits.UintSize < 64 {
+		t.Skip("counts above MaxUint32 need 64 bit integers")
+	}
+
+	data := &Data{}
+	if err := data.NewMode(21, ModeForward); err != nil {
+		t.Fatal(err)
+	}
+
+	kmer := strings.Repeat("ACG", 7)
+	if err := data.Inc(kmer); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Inc(strings.Repeat("T", 21)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a runtime conversion, as the constant does not fit a 32 bit int
+	large := uint64(math.MaxUint32)
+	words, _ := EncodeKmerWords([]byte(kmer))
+	sh    := &data.shards[data.shardWords(words)]
+	sh.inc(words, int(large))
+
+	dbName := filepath.Join(t.TempDir(), "kmers.db")
+	if err := data.SaveDB(dbName, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenKmerDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if count, err := db.Lookup(kmer); err != nil || uint64(count) != math.MaxUint32 {
+		t.Fatalf("saturated count %d %v, expected %d", count, err, uint64(math.MaxUint32))
+	}
+	if count, err := db.Lookup(strings.Repeat("T", 21)); err != nil || count != 1 {
+		t.Fatalf("count %d %v, expected 1", count, err)
+	}
+}
@@ -7,20 +7,22 @@ package kmertools
 
 
 import (
-//	"bufio"
+	"bufio"
 //	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"math"
+	"math/bits"
 //	"unicode"
 )
 
 
 import (
+        "github.com/sauloalgolang/fastareader/lib/fastaio"
         "github.com/sauloalgolang/fastareader/lib/fastatools"
 )
 
@@ -28,50 +30,61 @@ import (
 var (
 	ErrInternal   = errors.New("kmertools: internal error" )
 	ErrInvalidSeq = errors.New("kmertools: invalid fasta"  )
+	ErrNoPeak     = errors.New("kmertools: no coverage peak")
 )
 
 
 // Available output formats
-var AvailableFormats = [3]string{ "fasta", "list", "csv" }
-
+// histo is the count spectrum. see Histogram. db is binary. see SaveDB
+var AvailableFormats = [5]string{ "fasta", "list", "csv", "histo", "db" }
+
+// Counting modes
+const (
+	ModeCanonical = "canonical" // the smaller of each kmer and its reverse complement
+	ModeForward   = "forward"   // kmers as read, for stranded data
+	ModeBoth      = "both"      // as canonical, keeping the count of each strand
+)
 
-/*
-check : This helper will streamline our error checks below.
-src   : https://gobyexample.com/reading-files
-inputs: e error
-*/
-func check(e error) {
-	if e != nil {
-		log.Fatal(e)
-		panic(e)
-	}
-}
+// Available counting modes
+var AvailableModes = [3]string{ ModeCanonical, ModeForward, ModeBoth }
 
 
 
 /*
-src: https://github.com/golang/exp/blob/master/shootout/reverse-complement.go
+complement: complement of each IUPAC nucleotide code, keeping the case.
+            U (RNA) complements to A. gaps complement to themselves.
+            0 for bytes that are not nucleotides
+src       : https://github.com/golang/exp/blob/master/shootout/reverse-complement.go
 */
-/*
 var complement = [256]uint8{
-	'A': 'T', 'a': 'T',
-	'C': 'G', 'c': 'G',
-	'G': 'C', 'g': 'C',
-	'T': 'A', 't': 'A',
-	'U': 'A', 'u': 'A',
-	'M': 'K', 'm': 'K',
-	'R': 'Y', 'r': 'Y',
-	'W': 'W', 'w': 'W',
-	'S': 'S', 's': 'S',
-	'Y': 'R', 'y': 'R',
-	'K': 'M', 'k': 'M',
-	'V': 'B', 'v': 'B',
-	'H': 'D', 'h': 'D',
-	'D': 'H', 'd': 'H',
-	'B': 'V', 'b': 'V',
-	'N': 'N', 'n': 'N',
+	'A': 'T', 'a': 't',
+	'C': 'G', 'c': 'g',
+	'G': 'C', 'g': 'c',
+	'T': 'A', 't': 'a',
+	'U': 'A', 'u': 'a',
+	'M': 'K', 'm': 'k',
+	'R': 'Y', 'r': 'y',
+	'W': 'W', 'w': 'w',
+	'S': 'S', 's': 's',
+	'Y': 'R', 'y': 'r',
+	'K': 'M', 'k': 'm',
+	'V': 'B', 'v': 'b',
+	'H': 'D', 'h': 'd',
+	'D': 'H', 'd': 'h',
+	'B': 'V', 'b': 'v',
+	'N': 'N', 'n': 'n',
+	'-': '-', '.': '.',
 }
+
+/*
+complementRNA: as complement, but A complements to U
 */
+var complementRNA = func() (table [256]uint8) {
+	table      = complement
+	table['A'] = 'U'
+	table['a'] = 'u'
+	return table
+}()
 
 
 
@@ -94,30 +107,17 @@ func Map(f func(byte) byte, vs []byte) ([]byte) {
 
 
 /*
-rcer   : completement a byte nucleotide, returning a byte
+rcer   : completement a byte nucleotide, returning a byte.
+         bytes that are not IUPAC codes become N
 inputs : r byte
 outputs: byte
 src    : https://golang.org/pkg/strings/#Map
 */
 func rcer(r byte) (byte) {
-	switch {
-		case r == 'A': return 'T'
-		case r == 'a': return 'T'
-
-		case r == 'C': return 'G'
-		case r == 'c': return 'G'
-
-		case r == 'G': return 'C'
-		case r == 'g': return 'C'
-
-		case r == 'T': return 'A'
-		case r == 't': return 'A'
-
-		case r == 'N': return 'N'
-		case r == 'n': return 'N'
+	if c := complement[r]; c != 0 {
+		return c
 	}
-	log.Panic("unknown byte", string(r), " ", r)
-	return r
+	return 'N'
 }
 
 
@@ -134,6 +134,12 @@ func Reverse(sequence []byte) {
 }
 
 
+/*
+ReverseComplement: reverse complement of a DNA sequence, keeping the case.
+                   bytes that are not IUPAC codes become N
+inputs           : src []byte
+outputs          : []byte
+*/
 func ReverseComplement(src []byte) ([]byte) {
 	dst := make([]byte, len(src))
 
@@ -148,6 +154,50 @@ func ReverseComplement(src []byte) ([]byte) {
 
 
 
+/*
+ReverseComplementStrict: reverse complement of a DNA sequence, failing on
+                         bytes that are not IUPAC codes
+inputs                 : src []byte
+outputs                : []byte
+                         error
+*/
+func ReverseComplementStrict(src []byte) ([]byte, error) {
+	return reverseComplementTable(src, &complement)
+}
+
+
+
+/*
+ReverseComplementRNA: reverse complement of a RNA sequence, failing on
+                      bytes that are not IUPAC codes
+inputs              : src []byte
+outputs             : []byte
+                      error
+*/
+func ReverseComplementRNA(src []byte) ([]byte, error) {
+	return reverseComplementTable(src, &complementRNA)
+}
+
+
+
+func reverseComplementTable(src []byte, table *[256]uint8) ([]byte, error) {
+	dst := make([]byte, len(src))
+
+	ls  := len(src)
+
+	for i := 0; i < ls; i++ {
+		c := table[src[ls-i-1]]
+		if c == 0 {
+			return nil, fmt.Errorf("%w: invalid nucleotide '%c' (%d) at position %d", ErrInvalidSeq, src[ls-i-1], src[ls-i-1], ls-i-1)
+		}
+		dst[i] = c
+	}
+
+	return dst, nil
+}
+
+
+
 /*
 IsInSlice: checks whether a byte is present in a slice
 inputs   : a byte
@@ -168,51 +218,735 @@ func IsInSlice(a byte, list []byte) bool {
 
 
 
+// Number of shards of Data. a power of 2
+const DataShards = 256
+
+// Number of kmers buffered by extraction before being counted
+const kmerBatchSize = 4096
+
+// In ModeBoth the counter of a kmer holds the count of each strand, the
+// forward strand in the low strandBits bits. see strandCounts
+const strandBits        = 32
+const strandMask uint64 = 1 << strandBits - 1
+
+// Strands of ModeBoth counters
+const (
+	strandFwd uint = iota // the canonical kmer as read
+	strandRev             // the reverse complement of the canonical kmer as read
+)
+
 // https://tour.golang.org/concurrency/9
 // SafeCounter is safe to use concurrently.
+// kmers are stored 2 bit packed. see Kmer, and KmerWords for kmers longer
+// than MaxKmerSize
+// the kmers are hash partitioned in shards, each with its own lock, so
+// goroutines counting different kmers rarely wait for each other
 type Data struct {
-	v       map[string]int
-	Total   uint64
-	MaxSize int
-	mux     sync.RWMutex
+	// updated atomically. first, so they are 64 bit aligned on 32 bit
+	// platforms
+	Total     uint64
+	unique    int64
+	shards    []dataShard
+	shardBits uint
+	words     int      // 64 bit words per kmer
+	MaxSize   int      // number of possible kmers. 0 if it does not fit an int
+	KmerSize  int
+	Mode      string   // counting mode. see AvailableModes
+	Sources   []string // files counted, recorded by SaveDB
+}
+
+// only the map of the number of words of the kmers is created
+type dataShard struct {
+	v        map[Kmer]int     // up to MaxKmerSize bases
+	v128     map[kmer128]int  // up to 2 * MaxKmerSize bases
+	vLong    map[kmerLong]int // longer
+	mux      sync.Mutex
+	_        [32]byte // keep shards in different cache lines
 }
 
 // http://stackoverflow.com/questions/4498998/how-to-initialize-members-in-go-struct
-func (c *Data) New(kmerSize int) {
-    c.MaxSize = int(math.Pow(4,float64(kmerSize))/2)
-    c.v       = make(map[string]int, 0)//c.MaxSize)
+func (c *Data) New(kmerSize int) (err error) {
+    return c.NewMode(kmerSize, ModeCanonical)
+}
+
+/*
+NewMode: initializes the counter for a kmer size and counting mode
+inputs : kmerSize int
+         mode     string - see AvailableModes
+outputs: err      error
+*/
+func (c *Data) NewMode(kmerSize int, mode string) (err error) {
+    if kmerSize < 1 {
+        return fmt.Errorf("%w: kmer size %d must be positive", ErrInternal, kmerSize)
+    }
+    switch mode {
+    case ModeCanonical:
+        c.MaxSize = maxCanonicalKmers(kmerSize)
+    case ModeBoth:
+        if bits.UintSize < 2 * strandBits {
+            return fmt.Errorf("%w: counting mode '%s' needs 64 bit integers", ErrInternal, mode)
+        }
+        c.MaxSize = maxCanonicalKmers(kmerSize)
+    case ModeForward:
+        c.MaxSize = maxKmers(kmerSize)
+    default:
+        return fmt.Errorf("%w: unknown counting mode '%s'", ErrInternal, mode)
+    }
+    c.KmerSize  = kmerSize
+    c.Mode      = mode
+    c.words     = KmerWords(kmerSize)
+    c.shardBits = uint(bits.TrailingZeros(DataShards))
+    c.shards    = make([]dataShard, DataShards)
+    for i := range c.shards {
+        switch c.words {
+        case 1:
+            c.shards[i].v     = make(map[Kmer]int, 0)
+        case 2:
+            c.shards[i].v128  = make(map[kmer128]int, 0)
+        default:
+            c.shards[i].vLong = make(map[kmerLong]int, 0)
+        }
+    }
+    return nil
+}
+
+/*
+shard  : shard of a kmer. fibonacci hashing spreads neighbouring kmers
+inputs : kmer Kmer
+outputs: int
+*/
+func (c *Data) shard(kmer Kmer) int {
+	return int((uint64(kmer) * 0x9E3779B97F4A7C15) >> (64 - c.shardBits))
+}
+
+/*
+shardWords: shard of a kmer packed in words. the same as shard for kmers
+            of a single word
+inputs    : words []uint64
+outputs   : int
+*/
+func (c *Data) shardWords(words []uint64) int {
+	h := uint64(0)
+	for _, w := range words {
+		h = (h ^ w) * 0x9E3779B97F4A7C15
+	}
+	return int(h >> (64 - c.shardBits))
+}
+
+/*
+inc    : adds to the counter of a kmer packed in words. the shard must be
+         locked
+inputs : words []uint64
+         delta int
+outputs: count int - the new value of the counter
+*/
+func (sh *dataShard) inc(words []uint64, delta int) (count int) {
+	switch {
+	case sh.v != nil:
+		kmer := Kmer(words[0])
+		sh.v[kmer] += delta
+		return sh.v[kmer]
+	case sh.v128 != nil:
+		kmer := kmer128{ words[0], words[1] }
+		sh.v128[kmer] += delta
+		return sh.v128[kmer]
+	}
+	kmer := wordsToLong(words)
+	sh.vLong[kmer] += delta
+	return sh.vLong[kmer]
+}
+
+/*
+get    : counter of a kmer packed in words. the shard must be locked
+inputs : words []uint64
+outputs: int
+*/
+func (sh *dataShard) get(words []uint64) int {
+	switch {
+	case sh.v != nil:
+		return sh.v[Kmer(words[0])]
+	case sh.v128 != nil:
+		return sh.v128[kmer128{ words[0], words[1] }]
+	}
+	return sh.vLong[wordsToLong(words)]
+}
+
+/*
+each   : calls a function for every kmer of the shard and its count. the
+         shard must be locked
+inputs : words []uint64 - buffer the kmers are unpacked to
+         clbk  func(words []uint64, count int) error
+outputs: err   error - the first error returned by clbk
+*/
+func (sh *dataShard) each(words []uint64, clbk func(words []uint64, count int) error) (err error) {
+	for kmer, count := range sh.v {
+		words[0] = uint64(kmer)
+		if err = clbk(words, count); err != nil {
+			return err
+		}
+	}
+	for kmer, count := range sh.v128 {
+		copy(words, kmer[:])
+		if err = clbk(words, count); err != nil {
+			return err
+		}
+	}
+	for kmer, count := range sh.vLong {
+		longToWords(kmer, words)
+		if err = clbk(words, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+strandCounts: counts of each strand of a ModeBoth counter
+inputs      : value int
+outputs     : fwd   int
+              rev   int
+*/
+func strandCounts(value int) (fwd int, rev int) {
+	return int(uint64(value) & strandMask), int(uint64(value) >> strandBits)
+}
+
+/*
+strandDelta: value added to a ModeBoth counter by a kmer of a strand
+inputs     : strand uint
+outputs    : int
+*/
+func strandDelta(strand uint) int {
+	return 1 << (strand * strandBits)
+}
+
+/*
+counts : counts of each strand of a counter. out of ModeBoth, the count
+         and 0
+inputs : value int
+outputs: fwd   int
+         rev   int
+*/
+func (c *Data) counts(value int) (fwd int, rev int) {
+	if c.Mode == ModeBoth {
+		return strandCounts(value)
+	}
+	return value, 0
+}
+
+/*
+total  : count of a counter, adding both strands in ModeBoth
+inputs : value int
+outputs: int
+*/
+func (c *Data) total(value int) int {
+	fwd, rev := c.counts(value)
+	return fwd + rev
+}
+
+/*
+strandWrapped: whether a strand of a ModeBoth counter wrapped around after
+               adding to it
+inputs       : count  int - the new value of the counter
+               strand uint
+outputs      : bool
+*/
+func strandWrapped(count int, strand uint) bool {
+	return (uint64(count) >> (strand * strandBits)) & strandMask == 0
+}
+
+/*
+maxCanonicalKmers: number of distinct canonical kmers of a given size.
+                   half of 4^k, plus the palindromes for even sizes.
+                   0 if it does not fit an int, as for sizes over 31.
+                   the number of kmers held in memory is then limited by
+                   the memory itself, not by the kmer size
+inputs           : kmerSize int
+outputs          : int
+*/
+func maxCanonicalKmers(kmerSize int) int {
+	if kmerSize >= 32 {
+		return 0
+	}
+
+	count := uint64(1) << uint(2 * kmerSize) / 2
+	if kmerSize % 2 == 0 {
+		count += uint64(1) << uint(kmerSize) / 2
+	}
+
+	if count > math.MaxInt {
+		return 0
+	}
+
+	return int(count)
+}
+
+/*
+maxKmers: number of distinct kmers of a given size, 4^k.
+          0 if it does not fit an int. see maxCanonicalKmers
+inputs  : kmerSize int
+outputs : int
+*/
+func maxKmers(kmerSize int) int {
+	if kmerSize >= 32 || uint64(1) << uint(2 * kmerSize) > math.MaxInt {
+		return 0
+	}
+	return int(uint64(1) << uint(2 * kmerSize))
 }
 
 // Inc increments the counter for the given key.
-func (c *Data) Inc(key string) {
-	c.mux.Lock()
-	// Lock so only one goroutine at a time can access the map c.v.
-	c.v[key]++
-	c.Total++
+// in ModeBoth the key must be canonical and is counted on the forward strand
+func (c *Data) Inc(key string) (err error) {
+	if len(key) != c.KmerSize {
+		return fmt.Errorf("%w: kmer '%s' is not %d bases long", ErrInvalidSeq, key, c.KmerSize)
+	}
+	if c.words > 1 {
+		words, err := EncodeKmerWords([]byte(key))
+		if err != nil {
+			return err
+		}
+		return c.IncKmersWide(words)
+	}
+	kmer, err := EncodeKmer([]byte(key))
+	if err != nil {
+		return err
+	}
+	return c.IncKmer(kmer)
+}
 
-	if len(c.v) > c.MaxSize {
-		log.Panic(key)
+// IncKmer increments the counter for the given packed kmer.
+// in ModeBoth the kmer must be canonical and is counted on the forward strand.
+// fails for kmers longer than MaxKmerSize. see IncKmersWide
+func (c *Data) IncKmer(kmer Kmer) (err error) {
+	if c.words > 1 {
+		return fmt.Errorf("%w: kmers of %d bases do not fit a Kmer", ErrInternal, c.KmerSize)
 	}
 
-	c.mux.Unlock()
+	sh := &c.shards[c.shard(kmer)]
+
+	sh.mux.Lock()
+	// Lock so only one goroutine at a time can access the map sh.v.
+	sh.v[kmer]++
+	count := sh.v[kmer]
+	sh.mux.Unlock()
 
-	if (c.Total % 10000000) == 0 {
-		log.Println("Total Kmers:", c.Total, "Unique", len(c.v))
+	if c.Mode == ModeBoth && strandWrapped(count, strandFwd) {
+		return fmt.Errorf("%w: strand count of kmer '%s' over %d", ErrInternal, kmer.String(c.KmerSize), strandMask)
+	}
+
+	if count == 1 {
+		err = c.added(1, 1)
+	} else {
+		err = c.added(1, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("%w. last kmer '%s'", err, kmer.String(c.KmerSize))
 	}
+	return nil
+}
+
+/*
+IncKmers: increments the counters of many kmers, taking the lock of each
+          shard only once. in ModeBoth the kmers must be canonical and are
+          counted on the forward strand. fails for kmers longer than
+          MaxKmerSize. see IncKmersWide
+inputs  : kmers []Kmer
+outputs : err   error
+*/
+func (c *Data) IncKmers(kmers []Kmer) (err error) {
+	if c.words > 1 {
+		return fmt.Errorf("%w: kmers of %d bases do not fit a Kmer", ErrInternal, c.KmerSize)
+	}
+	return c.incKmers(kmers, strandFwd)
+}
+
+/*
+incKmers: as IncKmers, counting the kmers on a strand in ModeBoth
+inputs  : kmers  []Kmer
+          strand uint - ignored out of ModeBoth
+outputs : err    error
+*/
+func (c *Data) incKmers(kmers []Kmer, strand uint) (err error) {
+	if len(kmers) == 0 {
+		return nil
+	}
+
+	// counting sort of the kmers by shard
+	shardOf := make([]uint16, len(kmers))
+	starts  := make([]int, len(c.shards) + 1)
+	for i, kmer := range kmers {
+		shardOf[i] = uint16(c.shard(kmer))
+		starts[shardOf[i] + 1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+	sorted  := make([]Kmer, len(kmers))
+	next    := append([]int(nil), starts[:len(c.shards)]...)
+	for i, kmer := range kmers {
+		sorted[next[shardOf[i]]] = kmer
+		next[shardOf[i]]++
+	}
+
+	both     := c.Mode == ModeBoth
+	delta    := 1
+	if both {
+		delta = strandDelta(strand)
+	}
+
+	added    := int64(0)
+	overflow := -1 // position in sorted of a kmer whose strand count wrapped around
+	for s := range c.shards {
+		if starts[s] == starts[s+1] {
+			continue
+		}
+
+		sh := &c.shards[s]
+		sh.mux.Lock()
+		for i, kmer := range sorted[starts[s]:starts[s+1]] {
+			sh.v[kmer] += delta
+			count := sh.v[kmer]
+			if count == delta {
+				added++
+			}
+			if both && strandWrapped(count, strand) {
+				overflow = starts[s] + i
+			}
+		}
+		sh.mux.Unlock()
+	}
+
+	if overflow != -1 {
+		return fmt.Errorf("%w: strand count of kmer '%s' over %d", ErrInternal, sorted[overflow].String(c.KmerSize), strandMask)
+	}
+
+	if err = c.added(uint64(len(kmers)), added); err != nil {
+		return fmt.Errorf("%w. last kmer '%s'", err, kmers[len(kmers)-1].String(c.KmerSize))
+	}
+	return nil
+}
+
+/*
+IncKmersWide: as IncKmers, for kmers of any size packed in words. see
+              KmerWords
+inputs      : kmers []uint64 - the words of each kmer, one kmer after the other
+outputs     : err   error
+*/
+func (c *Data) IncKmersWide(kmers []uint64) (err error) {
+	return c.incKmersWide(kmers, strandFwd)
+}
+
+/*
+incKmersWide: as IncKmersWide, counting the kmers on a strand in ModeBoth
+inputs      : kmers  []uint64
+              strand uint - ignored out of ModeBoth
+outputs     : err    error
+*/
+func (c *Data) incKmersWide(kmers []uint64, strand uint) (err error) {
+	w := c.words
+	n := len(kmers) / w
+	if len(kmers) % w != 0 {
+		return fmt.Errorf("%w: %d words do not hold kmers of %d words", ErrInternal, len(kmers), w)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	// counting sort of the kmer positions by shard
+	shardOf := make([]uint16, n)
+	starts  := make([]int, len(c.shards) + 1)
+	for i := 0; i < n; i++ {
+		shardOf[i] = uint16(c.shardWords(kmers[i*w : i*w+w]))
+		starts[shardOf[i] + 1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+	sorted  := make([]int, n)
+	next    := append([]int(nil), starts[:len(c.shards)]...)
+	for i := 0; i < n; i++ {
+		sorted[next[shardOf[i]]] = i
+		next[shardOf[i]]++
+	}
+
+	both     := c.Mode == ModeBoth
+	delta    := 1
+	if both {
+		delta = strandDelta(strand)
+	}
+
+	added    := int64(0)
+	overflow := -1 // kmer whose strand count wrapped around
+	for s := range c.shards {
+		if starts[s] == starts[s+1] {
+			continue
+		}
+
+		sh := &c.shards[s]
+		sh.mux.Lock()
+		for _, i := range sorted[starts[s]:starts[s+1]] {
+			count := sh.inc(kmers[i*w : i*w+w], delta)
+			if count == delta {
+				added++
+			}
+			if both && strandWrapped(count, strand) {
+				overflow = i
+			}
+		}
+		sh.mux.Unlock()
+	}
+
+	if overflow != -1 {
+		return fmt.Errorf("%w: strand count of kmer '%s' over %d", ErrInternal, DecodeKmerWords(kmers[overflow*w : overflow*w+w], c.KmerSize), strandMask)
+	}
+
+	if err = c.added(uint64(n), added); err != nil {
+		return fmt.Errorf("%w. last kmer '%s'", err, DecodeKmerWords(kmers[len(kmers)-w:], c.KmerSize))
+	}
+	return nil
+}
+
+/*
+KmerBatch: buffers kmers of a single goroutine, counting them in Data
+           in batches. Flush must be called after the last Add
+*/
+type KmerBatch struct {
+	data    *Data
+	kmers   []Kmer
+	wide    []uint64 // kmers longer than MaxKmerSize. see IncKmersWide
+	rev     []Kmer   // ModeBoth kmers read on the reverse strand
+	wideRev []uint64 // ModeBoth kmers longer than MaxKmerSize read on the reverse strand
+}
+
+/*
+NewBatch: creates a batch counting into this Data
+outputs : *KmerBatch
+*/
+func (c *Data) NewBatch() *KmerBatch {
+	if c.words > 1 {
+		return &KmerBatch{ data: c, wide: make([]uint64, 0, kmerBatchSize * c.words) }
+	}
+	return &KmerBatch{ data: c, kmers: make([]Kmer, 0, kmerBatchSize) }
+}
+
+/*
+Add    : buffers a kmer, counting the buffer when full. fails for kmers
+         longer than MaxKmerSize. see AddWords
+inputs : kmer Kmer
+outputs: err  error
+*/
+func (b *KmerBatch) Add(kmer Kmer) (err error) {
+	if b.data.words > 1 {
+		return fmt.Errorf("%w: kmers of %d bases do not fit a Kmer", ErrInternal, b.data.KmerSize)
+	}
+	b.kmers = append(b.kmers, kmer)
+	if len(b.kmers) == kmerBatchSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+/*
+AddWords: buffers a kmer longer than MaxKmerSize, counting the buffer when
+          full. the words are copied. fails for kmers of a single word.
+          see Add
+inputs  : words []uint64
+outputs : err   error
+*/
+func (b *KmerBatch) AddWords(words []uint64) (err error) {
+	if b.data.words == 1 || len(words) != b.data.words {
+		return fmt.Errorf("%w: kmer of %d words in a batch of kmers of %d bases", ErrInternal, len(words), b.data.KmerSize)
+	}
+	b.wide = append(b.wide, words...)
+	if len(b.wide) == kmerBatchSize * b.data.words {
+		return b.Flush()
+	}
+	return nil
+}
+
+/*
+addRev : buffers a canonical kmer read on the reverse strand, for ModeBoth,
+         counting the buffer when full
+inputs : kmer Kmer
+outputs: err  error
+*/
+func (b *KmerBatch) addRev(kmer Kmer) (err error) {
+	b.rev = append(b.rev, kmer)
+	if len(b.rev) == kmerBatchSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+/*
+addWordsRev: as addRev, for kmers longer than MaxKmerSize. the words are
+             copied
+inputs     : words []uint64
+outputs    : err   error
+*/
+func (b *KmerBatch) addWordsRev(words []uint64) (err error) {
+	b.wideRev = append(b.wideRev, words...)
+	if len(b.wideRev) == kmerBatchSize * b.data.words {
+		return b.Flush()
+	}
+	return nil
+}
+
+/*
+Flush  : counts the buffered kmers
+outputs: err  error
+*/
+func (b *KmerBatch) Flush() (err error) {
+	if b.data.words > 1 {
+		err       = b.data.incKmersWide(b.wide, strandFwd)
+		if err == nil {
+			err   = b.data.incKmersWide(b.wideRev, strandRev)
+		}
+		b.wide    = b.wide[:0]
+		b.wideRev = b.wideRev[:0]
+		return err
+	}
+	err     = b.data.incKmers(b.kmers, strandFwd)
+	if err == nil {
+		err = b.data.incKmers(b.rev, strandRev)
+	}
+	b.kmers = b.kmers[:0]
+	b.rev   = b.rev[:0]
+	return err
+}
+
+/*
+added  : updates the totals after counting kmers, reporting progress
+inputs : total  uint64 - kmers counted
+         unique int64  - kmers seen for the first time
+outputs: err    error
+*/
+func (c *Data) added(total uint64, unique int64) (err error) {
+	newTotal  := atomic.AddUint64(&c.Total, total)
+	newUnique := atomic.AddInt64(&c.unique, unique)
+
+	if c.MaxSize > 0 && newUnique > int64(c.MaxSize) {
+		return fmt.Errorf("%w: more than %d unique kmers", ErrInternal, c.MaxSize)
+	}
+
+	if (newTotal / 10000000) != ((newTotal - total) / 10000000) {
+		log.Println("Total Kmers:", newTotal, "Unique", newUnique)
+	}
+
+	return nil
 }
 
 // Value returns the current value of the counter for the given key.
+// in ModeBoth the count of both strands. see ValueStrands
 func (c *Data) Value(key string) int {
-	c.mux.Lock()
-	// Lock so only one goroutine at a time can access the map c.v.
-	defer c.mux.Unlock()
-	return c.v[key]
+	if len(key) != c.KmerSize {
+		return 0
+	}
+	words, err := EncodeKmerWords([]byte(key))
+	if err != nil {
+		return 0
+	}
+	return c.ValueWords(words)
+}
+
+/*
+ValueStrands: counts of each strand of a key, in ModeBoth. the key must be
+              canonical, as stored. see Value
+inputs      : key string
+outputs     : fwd int - times the key was read
+              rev int - times its reverse complement was read
+              err error
+*/
+func (c *Data) ValueStrands(key string) (fwd int, rev int, err error) {
+	if c.Mode != ModeBoth {
+		return 0, 0, fmt.Errorf("%w: counting mode '%s' has no strand counts", ErrInternal, c.Mode)
+	}
+	if len(key) != c.KmerSize {
+		return 0, 0, fmt.Errorf("%w: kmer '%s' is not %d bases long", ErrInvalidSeq, key, c.KmerSize)
+	}
+	words, err := EncodeKmerWords([]byte(key))
+	if err != nil {
+		return 0, 0, err
+	}
+	sh := &c.shards[c.shardWords(words)]
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+	fwd, rev = strandCounts(sh.get(words))
+	return fwd, rev, nil
+}
+
+// ValueKmer returns the current value of the counter for the given packed kmer.
+// 0 for kmers longer than MaxKmerSize. see ValueWords
+func (c *Data) ValueKmer(kmer Kmer) int {
+	sh := &c.shards[c.shard(kmer)]
+	sh.mux.Lock()
+	// Lock so only one goroutine at a time can access the map sh.v.
+	defer sh.mux.Unlock()
+	return c.total(sh.v[kmer])
+}
+
+// ValueWords returns the current value of the counter for the given kmer
+// packed in words. see KmerWords
+func (c *Data) ValueWords(words []uint64) int {
+	if len(words) != c.words {
+		return 0
+	}
+	sh := &c.shards[c.shardWords(words)]
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+	return c.total(sh.get(words))
 }
 
 func (c *Data) Len() int {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	return len(c.v)
+	return int(atomic.LoadInt64(&c.unique))
+}
+
+/*
+Each   : calls a function for every kmer and its count, shard by shard, in no
+         particular order. the shard being visited is locked. fails for
+         kmers longer than MaxKmerSize. see EachWords
+inputs : clbk func(kmer Kmer, count int) error
+outputs: err  error - the first error returned by clbk
+*/
+func (c *Data) Each(clbk func(kmer Kmer, count int) error) (err error) {
+	if c.words > 1 {
+		return fmt.Errorf("%w: kmers of %d bases do not fit a Kmer", ErrInternal, c.KmerSize)
+	}
+	return c.EachWords(func(words []uint64, count int) error {
+		return clbk(Kmer(words[0]), count)
+	})
+}
+
+/*
+EachWords: as Each, for kmers of any size packed in words. the words are
+           only valid during the call. in ModeBoth the count adds both
+           strands
+inputs   : clbk func(words []uint64, count int) error
+outputs  : err  error - the first error returned by clbk
+*/
+func (c *Data) EachWords(clbk func(words []uint64, count int) error) (err error) {
+	return c.eachValue(func(words []uint64, value int) error {
+		return clbk(words, c.total(value))
+	})
+}
+
+/*
+eachValue: as EachWords, giving the counters as stored. see counts
+inputs   : clbk func(words []uint64, value int) error
+outputs  : err  error - the first error returned by clbk
+*/
+func (c *Data) eachValue(clbk func(words []uint64, value int) error) (err error) {
+	words := make([]uint64, c.words)
+
+	for s := range c.shards {
+		sh := &c.shards[s]
+		sh.mux.Lock()
+		err = sh.each(words, clbk)
+		sh.mux.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 /*
@@ -220,39 +954,108 @@ SaveKmers: save data into a fasta in a given format
 inputs   : outFileName string
            as          string
            data        map[string]int
+outputs  : err         error
 */
-func (c *Data) SaveAs(outFileName string, as string) {
-	outFileNameTmp := outFileName + ".tmp"
+func (c *Data) SaveAs(outFileName string, as string) (err error) {
+	return c.SaveAsWith(outFileName, as, SaveOptions{})
+}
+
+/*
+SaveAsWith: as SaveAs, saving only the kmers selected by the options, in
+            their order. the options do not apply to histo, which
+            always covers all the kmers
+inputs    : outFileName string
+            as          string
+            opts        SaveOptions
+outputs   : err         error
+*/
+func (c *Data) SaveAsWith(outFileName string, as string, opts SaveOptions) (err error) {
+	if as == "histo" {
+		h, err := c.Histogram(DefaultHistoMax)
+		if err != nil {
+			return err
+		}
+		return h.SaveAs(outFileName)
+	}
+
+	if as == "db" {
+		return c.SaveDB(outFileName, opts)
+	}
+
+	if as != "fasta" && as != "list" && as != "csv" {
+		return fmt.Errorf("%w: unknown format '%s'", ErrInternal, as)
+	}
+
+	if err = opts.check(); err != nil {
+		return err
+	}
 
 	//log.Println(c)
 
-	fo, err        := os.Create(outFileNameTmp)
-	check(err)
-	defer func() {
-		os.Remove(outFileNameTmp)
-	}()
-	defer fo.Close()
+	fo, err        := fastaio.CreateTemp(outFileName)
+	if err != nil {
+		return err
+	}
+	defer fastaio.DiscardTemp(fo)
+
+	bw             := bufio.NewWriter(fo)
+
+	// csv and list start with a comment recording how the kmers were counted
+	// and selected. in ModeBoth csv has a column for the count of each strand
+	if as != "fasta" {
+		columns := ""
+		if as == "csv" {
+			columns = " columns: kmer count"
+			if c.Mode == ModeBoth {
+				columns = " columns: kmer forward reverse"
+			}
+		}
+		if _, err = fmt.Fprintf(bw, "#kmer_size: %d mode: %s %s%s\n", c.KmerSize, c.Mode, opts, columns); err != nil {
+			return fmt.Errorf("%s: %w", outFileName, err)
+		}
+	}
 
 	i := 0
-	for k, v := range c.v {
+	err = c.eachSelected(opts, func(words []uint64, value int) (err error) {
 		i++
 
-		//log.Println(i,v,k)
+		k        := DecodeKmerWords(words, c.KmerSize)
+		fwd, rev := c.counts(value)
+
+		//log.Println(i,value,k)
 
 		if as == "fasta" {
-			fmt.Fprintf(fo, ">%d count: %d\n%s\n\n", i, v, k)
+			if c.Mode == ModeBoth {
+				_, err = fmt.Fprintf(bw, ">%d count: %d forward: %d reverse: %d mode: %s\n%s\n\n", i, fwd + rev, fwd, rev, c.Mode, k)
+			} else {
+				_, err = fmt.Fprintf(bw, ">%d count: %d mode: %s\n%s\n\n", i, fwd, c.Mode, k)
+			}
 		} else
 		if as == "list"  {
-			fmt.Fprintf(fo, "%s\n", k)
+			_, err = fmt.Fprintf(bw, "%s\n", k)
 		} else
 		if as == "csv"   {
-			fmt.Fprintf(fo, "%s\t%d\n", k, v)
+			if c.Mode == ModeBoth {
+				_, err = fmt.Fprintf(bw, "%s\t%d\t%d\n", k, fwd, rev)
+			} else {
+				_, err = fmt.Fprintf(bw, "%s\t%d\n", k, fwd)
+			}
 		}
+
+		return err
+	})
+
+	if err == nil {
+		err = bw.Flush()
 	}
 
-	fo.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", outFileName, err)
+	}
+
+	log.Println("Saved", i, "kmers")
 
-	os.Rename(outFileNameTmp, outFileName)
+	return fastaio.CommitTemp(fo, outFileName)
 }
 
 
@@ -262,10 +1065,11 @@ ExtractKmers: Extract kmers, storing them in data
 input       : seqd     *fastatools.SeqData
               kmerSize int
               data     map[string]int
+output      : err      error
 */
 
-func ExtractKmers(seqd *fastatools.SeqData, kmerSize int, data *Data) {
-	ExtractKmersFromSeq(seqd.Sequence, seqd.SeqName, kmerSize, data)
+func ExtractKmers(seqd *fastatools.SeqData, kmerSize int, data *Data) (err error) {
+	return ExtractKmersFromSeq(seqd.Sequence, seqd.SeqName, kmerSize, data)
 }
 
 
@@ -276,123 +1080,222 @@ ExtractKmers: Extract kmers, storing them in data
 input       : seqd     *fastatools.SeqData
               kmerSize int
               data     map[string]int
+output      : err      error
 */
-func ExtractKmersFromSeq(sequence []byte, seqName string, kmerSize int, data *Data) {
+func ExtractKmersFromSeq(sequence []byte, seqName string, kmerSize int, data *Data) (err error) {
 	if len(sequence) < kmerSize {
-		return
+		return nil
 	}
 
-	seqLen  := len(sequence)
+	ex, err := data.NewExtractor()
+	if err != nil {
+		return err
+	}
 
-	rc      := ReverseComplement(sequence)
+	if err = ex.Extract(sequence, seqName); err != nil {
+		return err
+	}
 
-	fwd     := ""
-	rev     := ""
+	if err = ex.Flush(); err != nil {
+		return fmt.Errorf("%s: %w", seqName, err)
+	}
 
-	fStart  := 0
-	rStart  := 0
+	return nil
+}
 
-	fEnd    := 0
-	rEnd    := 0
 
-	hadN    := true
 
-	for fStart = 0; fStart < (seqLen-kmerSize+1); fStart++ {
-		fEnd   = fStart + kmerSize
-		fwd    = string(sequence[fStart:fEnd])
+/*
+KmerExtractor: extracts the kmers of many sequences, one after the other,
+               into a single batch, so that short sequences, as reads, do
+               not each pay for a roller and a batch. not safe for
+               concurrent use. Flush must be called after the last Extract
+*/
+type KmerExtractor struct {
+	roller roller
+	batch  *KmerBatch
+}
 
-		if ( hadN ) {
-			hadN = false
-			for _, n := range fwd {
-				if ! ( n == 'A' || n == 'C' || n == 'G' || n == 'T' ) {
-					hadN = true
-					break
-				}
-			}
-			if hadN {
-				continue
-			}
-		} else {
-			n := fwd[kmerSize-1]
-			if ! ( n == 'A' || n == 'C' || n == 'G' || n == 'T' ) {
-				hadN = true
-				continue
-			}
-		}
+/*
+NewExtractor: creates an extractor counting into this Data
+outputs     : *KmerExtractor
+              error
+*/
+func (c *Data) NewExtractor() (*KmerExtractor, error) {
+	r, err := newRoller(c.KmerSize)
+	if err != nil {
+		return nil, err
+	}
+	return &KmerExtractor{ roller: r, batch: c.NewBatch() }, nil
+}
 
-		rStart = seqLen - fStart   - kmerSize
-		rEnd   = rStart + kmerSize
-		rev    = string(rc[      rStart:rEnd])
-
-		/*
-		if p {
-		log.Printf( "%s", sequence)
-		log.Printf( "%s", rc      )
-		log.Printf( "fStart %12d fEnd %12d len %d fwd %s", fStart, fEnd, len(fwd), fwd)
-		log.Println( []byte(fwd) )
-		log.Printf( "rStart %12d rEnd %12d len %d rev %s", rStart, rEnd, len(rev), rev)
-		log.Println( []byte(rev) )
-		log.Println("smaller", (fwd<rev))
-		log.Println()
-		}
-		*/
+/*
+Extract: buffers the kmers of a sequence, counting the batch when full
+inputs : sequence []byte
+         seqName  string
+outputs: err      error
+*/
+func (e *KmerExtractor) Extract(sequence []byte, seqName string) (err error) {
+	e.roller.Reset()
+	return extractKmersRolling(sequence, seqName, e.roller, e.batch)
+}
 
-		if fwd<rev {
-			data.Inc(fwd)
-		} else {
-			data.Inc(rev)
-		}
-	}
+/*
+Flush  : counts the buffered kmers
+outputs: err error
+*/
+func (e *KmerExtractor) Flush() (err error) {
+	return e.batch.Flush()
 }
 
 
 
+/*
+roller : rolls the kmers of a sequence. KmerRoller for kmers of up to
+         MaxKmerSize bases, KmerRollerWide for longer ones
+*/
+type roller interface {
+	Reset()
+	Push(b byte) (full bool)
+	add(batch *KmerBatch, mode string) (err error)
+}
 
+/*
+newRoller: creates the roller of a kmer size
+inputs   : kmerSize int
+outputs  : roller
+           error
+*/
+func newRoller(kmerSize int) (roller, error) {
+	if kmerSize > MaxKmerSize {
+		r, err := NewKmerRollerWide(kmerSize)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
 
-func GetExtractKmersIterClbk( kmerSize int, data *Data ) func(*string)bool {
-        log.Println("GetExtractKmersIterClbk")
+	r, err := NewKmerRoller(kmerSize)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	sequence := make([]byte, 0)
-	seqName  := ""
+/*
+add    : adds the kmers of the counting mode at the current position
+inputs : batch *KmerBatch
+         mode  string
+outputs: err   error
+*/
+func (r *KmerRoller) add(batch *KmerBatch, mode string) (err error) {
+	switch mode {
+	case ModeForward:
+		return batch.Add(r.Fwd)
+	case ModeBoth:
+		// the canonical kmer, on the strand it was read from. palindromes
+		// are counted on the forward strand
+		if r.Fwd <= r.Rev {
+			return batch.Add(r.Fwd)
+		}
+		return batch.addRev(r.Rev)
+	}
+	return batch.Add(r.Canonical())
+}
 
-	lineTot := 0
-	lineSeq := 0
+/*
+add    : as KmerRoller.add
+inputs : batch *KmerBatch
+         mode  string
+outputs: err   error
+*/
+func (r *KmerRollerWide) add(batch *KmerBatch, mode string) (err error) {
+	switch mode {
+	case ModeForward:
+		return batch.AddWords(r.Fwd)
+	case ModeBoth:
+		if CompareKmerWords(r.Fwd, r.Rev) <= 0 {
+			return batch.AddWords(r.Fwd)
+		}
+		return batch.addWordsRev(r.Rev)
+	}
+	return batch.AddWords(r.Canonical())
+}
 
-	ExtractKmersIterClbk := func(line *string)bool {
-		lineTot++
-                if (*line)[0] == '>' {
-                        if seqName == "" { // first
-                                seqName  = strings.TrimSpace((*line)[1:])
-                                log.Println("Seq", seqName, "STARTING")
-                                return true
+/*
+extractKmersRolling: pushes the bases of a sequence into a roller, adding
+                     the kmers of the counting mode of the batch at every
+                     position where it is full. the roller keeps its state
+                     between calls, so a sequence can be given in pieces
+input              : sequence []byte
+                     seqName  string
+                     r        roller
+                     batch    *KmerBatch
+output             : err      error
+*/
+func extractKmersRolling(sequence []byte, seqName string, r roller, batch *KmerBatch) (err error) {
+	mode := batch.data.Mode
+
+	// kmers of a single word, the common case, are rolled without
+	// going through the interface
+	if kr, ok := r.(*KmerRoller); ok {
+		for _, b := range sequence {
+			if ! kr.Push(b) {
+				continue
+			}
+			if err = kr.add(batch, mode); err != nil {
+				return fmt.Errorf("%s: %w", seqName, err)
+			}
+		}
+		return nil
+	}
 
-                        } else { //next
-                                log.Println("Seq", seqName, "DONE"    )
-                                return false
+	for _, b := range sequence {
+		if ! r.Push(b) {
+			continue
+		}
+		if err = r.add(batch, mode); err != nil {
+			return fmt.Errorf("%s: %w", seqName, err)
+		}
+	}
 
-                        }
-                } else {
-			lineSeq++
-                        if len(*line) != 0 {
-				//log.Println(len(*line), *line)
+	return nil
+}
 
-				sequence = append( sequence, []byte(*line)... )
 
-				if len(sequence) >= kmerSize {
-					ExtractKmersFromSeq(sequence, seqName, kmerSize, data)
-					sequence = sequence[len(sequence)-kmerSize+1:]
-				}
 
-				//log.Println(len(sequence), string(sequence))
 
-				//log.Println()
-                        }
 
-                        return true
-                }
+/*
+ExtractKmersFromLines: extracts the kmers of the fasta record of a reader
+                       whose header has been read, line by line, so that
+                       the sequence is never held in memory. the batch
+                       must be flushed after reading
+input                : reader   *fastatools.Reader
+                       seqName  string
+                       kmerSize int
+                       batch    *KmerBatch
+output               : err      error
+*/
+func ExtractKmersFromLines(reader *fastatools.Reader, seqName string, kmerSize int, batch *KmerBatch) (err error) {
+	roller, err := newRoller(kmerSize)
+	if err != nil {
+		return err
 	}
 
-	return ExtractKmersIterClbk
+	for {
+		line, err := reader.ReadSeqLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", seqName, err)
+		}
+
+		if err = extractKmersRolling(line, seqName, roller, batch); err != nil {
+			return err
+		}
+	}
 }
 
 
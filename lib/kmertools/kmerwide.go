@@ -0,0 +1,224 @@
+package kmertools
+
+// kmers of any size packed in several 64 bit words
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+
+// Bases in a 64 bit word
+const wordBases = 32
+
+
+/*
+KmerWords: number of 64 bit words holding a kmer of a given size
+inputs   : kmerSize int
+outputs  : int
+*/
+func KmerWords(kmerSize int) int {
+	return (kmerSize + wordBases - 1) / wordBases
+}
+
+/*
+Packed kmers of any size are stored as []uint64 words, 2 bits per base as
+in Kmer, big endian: the first word holds the first (k-1)%32+1 bases in its
+least significant bits, and each following word 32 bases. comparing the
+words in order gives the same result as comparing the strings, and a
+kmer of up to 32 bases is a single word equal to its Kmer
+*/
+
+
+/*
+EncodeKmerWords: packs a sequence of any size
+inputs         : seq   []byte
+outputs        : words []uint64
+                 err   error
+*/
+func EncodeKmerWords(seq []byte) (words []uint64, err error) {
+	words = make([]uint64, KmerWords(len(seq)))
+
+	for i, b := range seq {
+		code := baseCodes[b]
+		if code < 0 {
+			return nil, fmt.Errorf("%w: invalid base '%c' at position %d of '%s'", ErrInvalidSeq, b, i, seq)
+		}
+		shiftWordsLeft(words, uint64(code))
+	}
+
+	return words, nil
+}
+
+/*
+DecodeKmerWords: unpacks a kmer
+inputs         : words    []uint64
+                 kmerSize int
+outputs        : []byte
+*/
+func DecodeKmerWords(words []uint64, kmerSize int) []byte {
+	seq := make([]byte, kmerSize)
+	w   := len(words) - 1
+	n   := 0
+
+	for i := kmerSize - 1; i >= 0; i-- {
+		seq[i] = codeBases[(words[w] >> uint(2 * n)) & 3]
+		n++
+		if n == wordBases {
+			n  = 0
+			w--
+		}
+	}
+
+	return seq
+}
+
+/*
+CompareKmerWords: compares two packed kmers of the same size
+inputs          : a []uint64
+                  b []uint64
+outputs         : int - -1, 0 or 1, as a is smaller, equal or larger than b
+*/
+func CompareKmerWords(a []uint64, b []uint64) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+/*
+shiftWordsLeft: moves the bases one position to the left, adding a base at
+                the end. bits shifted out of the first word are dropped and
+                must be masked by the caller
+inputs        : words []uint64
+                code  uint64
+*/
+func shiftWordsLeft(words []uint64, code uint64) {
+	last := len(words) - 1
+	for i := 0; i < last; i++ {
+		words[i] = words[i] << 2 | words[i+1] >> 62
+	}
+	words[last] = words[last] << 2 | code
+}
+
+
+/*
+kmer128: map key of kmers of 33 to 64 bases
+*/
+type kmer128 [2]uint64
+
+/*
+kmerLong: map key of kmers longer than 64 bases. the words in big endian
+          bytes
+*/
+type kmerLong string
+
+func wordsToLong(words []uint64) kmerLong {
+	buf := make([]byte, 8 * len(words))
+	for i, w := range words {
+		binary.BigEndian.PutUint64(buf[8*i:], w)
+	}
+	return kmerLong(buf)
+}
+
+func longToWords(key kmerLong, words []uint64) {
+	for i := range words {
+		words[i] = binary.BigEndian.Uint64([]byte(key[8*i : 8*i+8]))
+	}
+}
+
+
+/*
+KmerRollerWide: as KmerRoller, for kmers of any size
+*/
+type KmerRollerWide struct {
+	KmerSize int
+	Fwd      []uint64
+	Rev      []uint64
+	topMask  uint64 // bits of the first word in use
+	topShift uint   // position of the first base in the first word
+	valid    int    // number of valid bases since the last invalid one
+}
+
+/*
+NewKmerRollerWide: creates a roller for kmers of a given size
+inputs           : kmerSize int
+outputs          : r        *KmerRollerWide
+                   err      error
+*/
+func NewKmerRollerWide(kmerSize int) (r *KmerRollerWide, err error) {
+	if kmerSize < 1 {
+		return nil, fmt.Errorf("%w: kmer size %d must be positive", ErrInvalidSeq, kmerSize)
+	}
+
+	words    := KmerWords(kmerSize)
+	topBases := kmerSize - (words - 1) * wordBases
+
+	r = &KmerRollerWide{
+		KmerSize: kmerSize,
+		Fwd     : make([]uint64, words),
+		Rev     : make([]uint64, words),
+		topShift: uint(2 * (topBases - 1)),
+	}
+
+	// for full words the shift overflows to 0 and the mask has all bits set
+	r.topMask = uint64(1) << uint(2 * topBases) - 1
+
+	return r, nil
+}
+
+/*
+Reset  : forgets the bases pushed so far, as at the start of a new sequence
+*/
+func (r *KmerRollerWide) Reset() {
+	for i := range r.Fwd {
+		r.Fwd[i] = 0
+		r.Rev[i] = 0
+	}
+	r.valid = 0
+}
+
+/*
+Push   : adds a base to the end of the kmer. invalid bases restart it
+inputs : b byte
+outputs: full bool - true if the last KmerSize bases were all valid
+*/
+func (r *KmerRollerWide) Push(b byte) (full bool) {
+	code := baseCodes[b]
+	if code < 0 {
+		r.valid = 0
+		return false
+	}
+
+	shiftWordsLeft(r.Fwd, uint64(code))
+	r.Fwd[0] &= r.topMask
+
+	// the complement enters the reverse kmer at its first base
+	for i := len(r.Rev) - 1; i > 0; i-- {
+		r.Rev[i] = r.Rev[i] >> 2 | r.Rev[i-1] << 62
+	}
+	r.Rev[0] = r.Rev[0] >> 2 | uint64(3 - code) << r.topShift
+
+	if r.valid < r.KmerSize {
+		r.valid++
+	}
+
+	return r.valid == r.KmerSize
+}
+
+/*
+Canonical: the smaller of the forward kmer and its reverse complement.
+           the words are only valid until the next Push
+outputs  : []uint64
+*/
+func (r *KmerRollerWide) Canonical() []uint64 {
+	if CompareKmerWords(r.Fwd, r.Rev) <= 0 {
+		return r.Fwd
+	}
+	return r.Rev
+}
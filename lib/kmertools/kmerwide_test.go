@@ -0,0 +1,215 @@
+package kmertools
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+
+/*
+naiveRevComp: reverse complement of an ACGT string, base by base
+inputs      : seq string
+outputs     : string
+*/
+func naiveRevComp(seq string) string {
+	pairs := map[byte]byte{ 'A': 'T', 'C': 'G', 'G': 'C', 'T': 'A' }
+	rc    := make([]byte, len(seq))
+	for i := 0; i < len(seq); i++ {
+		rc[len(seq)-1-i] = pairs[seq[i]]
+	}
+	return string(rc)
+}
+
+/*
+naiveKmers: counts the kmers of sequences cutting every substring without
+            N. canonical kmers are the smaller string of each kmer and its
+            reverse complement
+inputs    : seqs     []string
+            kmerSize int
+            mode     string
+outputs   : map[string]int
+*/
+func naiveKmers(seqs []string, kmerSize int, mode string) map[string]int {
+	counts := make(map[string]int)
+	for _, seq := range seqs {
+		for i := 0; i + kmerSize <= len(seq); i++ {
+			kmer := seq[i : i+kmerSize]
+			if strings.Contains(kmer, "N") {
+				continue
+			}
+			if mode == ModeCanonical {
+				if rc := naiveRevComp(kmer); rc < kmer {
+					kmer = rc
+				}
+			}
+			counts[kmer]++
+		}
+	}
+	return counts
+}
+
+/*
+randomSeq: random sequence with an N every nEvery bases on average
+inputs   : rnd    *rand.Rand
+           size   int
+           nEvery int
+outputs  : string
+*/
+func randomSeq(rnd *rand.Rand, size int, nEvery int) string {
+	seq := make([]byte, size)
+	for i := range seq {
+		seq[i] = "ACGT"[rnd.Intn(4)]
+		if rnd.Intn(nEvery) == 0 {
+			seq[i] = 'N'
+		}
+	}
+	return string(seq)
+}
+
+
+func TestKmerWords(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, kmerSize := range []int{ 1, 31, 32, 33, 63, 64, 65, 70, 100 } {
+		for i := 0; i < 50; i++ {
+			a := randomSeq(rnd, kmerSize, 1 << 30)
+			b := randomSeq(rnd, kmerSize, 1 << 30)
+
+			wa, err := EncodeKmerWords([]byte(a))
+			if err != nil {
+				t.Fatalf("k %d: %v", kmerSize, err)
+			}
+			wb, err := EncodeKmerWords([]byte(b))
+			if err != nil {
+				t.Fatalf("k %d: %v", kmerSize, err)
+			}
+
+			if len(wa) != KmerWords(kmerSize) {
+				t.Fatalf("k %d: %d words, expected %d", kmerSize, len(wa), KmerWords(kmerSize))
+			}
+			if got := string(DecodeKmerWords(wa, kmerSize)); got != a {
+				t.Fatalf("k %d: decoded '%s', expected '%s'", kmerSize, got, a)
+			}
+			if got, want := CompareKmerWords(wa, wb), strings.Compare(a, b); got != want {
+				t.Fatalf("k %d: compare '%s' '%s' gave %d, expected %d", kmerSize, a, b, got, want)
+			}
+		}
+	}
+}
+
+
+func TestKmerRollerWide(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+
+	for _, kmerSize := range []int{ 32, 33, 64, 65, 70 } {
+		r, err := NewKmerRollerWide(kmerSize)
+		if err != nil {
+			t.Fatalf("k %d: %v", kmerSize, err)
+		}
+
+		seq := randomSeq(rnd, 2000, 97)
+		for i := 0; i < len(seq); i++ {
+			full := r.Push(seq[i])
+
+			start := i + 1 - kmerSize
+			want  := start >= 0 && ! strings.Contains(seq[start:i+1], "N")
+			if full != want {
+				t.Fatalf("k %d: position %d full %v, expected %v", kmerSize, i, full, want)
+			}
+			if ! full {
+				continue
+			}
+
+			kmer  := seq[start : i+1]
+			rc    := naiveRevComp(kmer)
+			canon := kmer
+			if rc < kmer {
+				canon = rc
+			}
+
+			if got := string(DecodeKmerWords(r.Fwd, kmerSize)); got != kmer {
+				t.Fatalf("k %d: position %d forward '%s', expected '%s'", kmerSize, i, got, kmer)
+			}
+			if got := string(DecodeKmerWords(r.Rev, kmerSize)); got != rc {
+				t.Fatalf("k %d: position %d reverse '%s', expected '%s'", kmerSize, i, got, rc)
+			}
+			if got := string(DecodeKmerWords(r.Canonical(), kmerSize)); got != canon {
+				t.Fatalf("k %d: position %d canonical '%s', expected '%s'", kmerSize, i, got, canon)
+			}
+		}
+	}
+}
+
+
+func TestExtractKmersWide(t *testing.T) {
+	tests := []struct {
+		kmerSize int
+		mode     string
+	}{
+		{ 32, ModeForward   }, { 32, ModeCanonical },
+		{ 33, ModeForward   }, { 33, ModeCanonical },
+		{ 64, ModeForward   }, { 64, ModeCanonical },
+		{ 65, ModeForward   }, { 65, ModeCanonical },
+		{ 70, ModeForward   }, { 70, ModeCanonical },
+	}
+
+	rnd  := rand.New(rand.NewSource(3))
+	seqs := []string{}
+	for i := 0; i < 20; i++ {
+		seqs = append(seqs, randomSeq(rnd, 50 + rnd.Intn(400), 150))
+	}
+	// repeats and palindromes, so that some kmers are counted more than once
+	seqs = append(seqs, strings.Repeat("ACGT", 60), strings.Repeat("A", 100) + strings.Repeat("T", 100))
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d_%s", tt.kmerSize, tt.mode), func(t *testing.T) {
+			data := &Data{}
+			if err := data.NewMode(tt.kmerSize, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, seq := range seqs {
+				if err := ExtractKmersFromSeq([]byte(seq), fmt.Sprint("seq", i), tt.kmerSize, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want  := naiveKmers(seqs, tt.kmerSize, tt.mode)
+			total := 0
+			for _, count := range want {
+				total += count
+			}
+
+			if data.Len() != len(want) {
+				t.Errorf("%d kmers, expected %d", data.Len(), len(want))
+			}
+			if data.Total != uint64(total) {
+				t.Errorf("total %d, expected %d", data.Total, total)
+			}
+
+			seen := 0
+			err  := data.EachWords(func(words []uint64, count int) error {
+				kmer := string(DecodeKmerWords(words, tt.kmerSize))
+				if want[kmer] != count {
+					return fmt.Errorf("kmer '%s' counted %d, expected %d", kmer, count, want[kmer])
+				}
+				seen++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen != len(want) {
+				t.Errorf("visited %d kmers, expected %d", seen, len(want))
+			}
+
+			for kmer, count := range want {
+				if got := data.Value(kmer); got != count {
+					t.Fatalf("value of '%s' %d, expected %d", kmer, got, count)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package kmertools
+
+// selection and order of the kmers saved by SaveAsWith
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+
+// Orders of the saved kmers
+const (
+	SortNone  = "none"  // as stored, in no particular order. needs no extra memory
+	SortKmer  = "kmer"  // lexicographic
+	SortCount = "count" // decreasing count, lexicographic between equal counts
+)
+
+// Available orders
+var AvailableSorts = [3]string{ SortNone, SortKmer, SortCount }
+
+
+// returned by callbacks to stop iterating before the last kmer
+var errStopEach = errors.New("kmertools: stop")
+
+
+/*
+SaveOptions: kmers saved and their order. the zero value saves all the
+             kmers in no particular order
+*/
+type SaveOptions struct {
+	MinCount int    // kmers counted fewer times are skipped. 0 for no limit
+	MaxCount int    // kmers counted more times are skipped. 0 for no limit
+	Sort     string // see AvailableSorts. "" is SortNone
+	Top      int    // only the first Top kmers of the order are saved. 0 for all
+}
+
+/*
+check  : validates the options
+outputs: err error
+*/
+func (o *SaveOptions) check() (err error) {
+	switch o.Sort {
+	case "", SortNone, SortKmer, SortCount:
+	default:
+		return fmt.Errorf("%w: unknown sort order '%s'", ErrInternal, o.Sort)
+	}
+
+	if o.MinCount < 0 || o.MaxCount < 0 || o.Top < 0 {
+		return fmt.Errorf("%w: count limits and top (%d, %d, %d) must be greater or equal to 0", ErrInternal, o.MinCount, o.MaxCount, o.Top)
+	}
+
+	if o.MaxCount > 0 && o.MaxCount < o.MinCount {
+		return fmt.Errorf("%w: maximum count %d smaller than minimum count %d", ErrInternal, o.MaxCount, o.MinCount)
+	}
+
+	return nil
+}
+
+/*
+keep   : whether a kmer with a given count is saved
+inputs : count int
+outputs: bool
+*/
+func (o *SaveOptions) keep(count int) bool {
+	return count >= o.MinCount && (o.MaxCount == 0 || count <= o.MaxCount)
+}
+
+/*
+String : the options, as recorded in the header of csv and list files
+outputs: string
+*/
+func (o SaveOptions) String() string {
+	sortBy := o.Sort
+	if sortBy == "" {
+		sortBy = SortNone
+	}
+	return fmt.Sprintf("min_count: %d max_count: %d sort: %s top: %d", o.MinCount, o.MaxCount, sortBy, o.Top)
+}
+
+
+/*
+EachSelected: calls a function for the kmers selected by the options, in
+              their order. sorting copies the selected kmers, so filtering
+              out kmers with low counts also saves memory
+inputs      : opts SaveOptions
+              clbk func(words []uint64, count int) error - see EachWords
+outputs     : err  error - the first error returned by clbk
+*/
+func (c *Data) EachSelected(opts SaveOptions, clbk func(words []uint64, count int) error) (err error) {
+	return c.eachSelected(opts, func(words []uint64, value int) error {
+		return clbk(words, c.total(value))
+	})
+}
+
+/*
+eachSelected: as EachSelected, giving the counters as stored. the options
+              apply to the count of both strands. see counts
+inputs      : opts SaveOptions
+              clbk func(words []uint64, value int) error
+outputs     : err  error - the first error returned by clbk
+*/
+func (c *Data) eachSelected(opts SaveOptions, clbk func(words []uint64, value int) error) (err error) {
+	if err = opts.check(); err != nil {
+		return err
+	}
+
+	if opts.Sort == "" || opts.Sort == SortNone {
+		n  := 0
+		err = c.eachValue(func(words []uint64, value int) error {
+			if ! opts.keep(c.total(value)) {
+				return nil
+			}
+			if opts.Top > 0 && n == opts.Top {
+				return errStopEach
+			}
+			n++
+			return clbk(words, value)
+		})
+		if err == errStopEach {
+			return nil
+		}
+		return err
+	}
+
+	// the selected kmers, packed one after the other
+	w      := c.words
+	flat   := make([]uint64, 0)
+	values := make([]int, 0)
+
+	err = c.eachValue(func(words []uint64, value int) error {
+		if opts.keep(c.total(value)) {
+			flat   = append(flat, words...)
+			values = append(values, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	order  := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+
+	kmerLess := func(a, b int) bool {
+		return CompareKmerWords(flat[a*w : a*w+w], flat[b*w : b*w+w]) < 0
+	}
+
+	if opts.Sort == SortCount {
+		sort.Slice(order, func(i, j int) bool {
+			a, b := order[i], order[j]
+			if ca, cb := c.total(values[a]), c.total(values[b]); ca != cb {
+				return ca > cb
+			}
+			return kmerLess(a, b)
+		})
+	} else {
+		sort.Slice(order, func(i, j int) bool { return kmerLess(order[i], order[j]) })
+	}
+
+	if opts.Top > 0 && opts.Top < len(order) {
+		order = order[:opts.Top]
+	}
+
+	for _, i := range order {
+		if err = clbk(flat[i*w : i*w+w], values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}